@@ -9,7 +9,7 @@ fi
 gofmt -s -w src/*.go
 # src/*/*.go
 
-go vet src/extend-api-service.go
+go vet ./src
 if [ $? -ne 0 ]; then
     exit
 fi
@@ -24,7 +24,17 @@ if [ $? -ne 0 ]; then
     exit
 fi
 
-OOS=linux GOARCH=amd64 go build -o extend-api-service src/extend-api-service.go
+go test -v github.com/tbolsh/extend-go-nginx-postgres-docker/jwt
+if [ $? -ne 0 ]; then
+    exit
+fi
+
+go test -v ./src
+if [ $? -ne 0 ]; then
+    exit
+fi
+
+OOS=linux GOARCH=amd64 go build -o extend-api-service ./src
 if [ $? -ne 0 ]; then
     exit
 fi
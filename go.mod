@@ -3,13 +3,21 @@ module github.com/providenceinnovation/c20-alexa-skills
 go 1.16
 
 replace (
+	github.com/tbolsh/extend-go-nginx-postgres-docker/extendpb v0.0.0 => ./src/extendpb
 	github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson v0.0.0 => ./src/genericjson
+	github.com/tbolsh/extend-go-nginx-postgres-docker/jwt v0.0.0 => ./src/jwt
 	github.com/tbolsh/extend-go-nginx-postgres-docker/persistense v0.0.0 => ./src/persistense
 )
 
 require (
+	github.com/BurntSushi/toml v1.1.0
 	github.com/gorilla/mux v1.8.0
+	github.com/graph-gophers/graphql-go v1.3.0
 	github.com/lib/pq v1.10.5 // indirect
+	github.com/tbolsh/extend-go-nginx-postgres-docker/extendpb v0.0.0
 	github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson v0.0.0
+	github.com/tbolsh/extend-go-nginx-postgres-docker/jwt v0.0.0
 	github.com/tbolsh/extend-go-nginx-postgres-docker/persistense v0.0.0
+	google.golang.org/grpc v1.46.2
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// primaryAccount is the Extend login stored with the API-Key itself, every client has it
+const primaryAccount = "primary"
+
+// account is an Extend login linked to a client in addition to the primary one of its API-Keys;
+// cards of every account of a client are listed together
+type account struct {
+	Id     string
+	Label  string
+	Email  string
+	Linked time.Time
+}
+
+const accountColumns = "id, label, email, COALESCE(EXTRACT(EPOCH FROM linked_at)::bigint, 0)"
+
+func accountFromRow(row []string) account {
+	return account{Id: row[0], Label: row[1], Email: row[2], Linked: unixOrZero(row[3])}
+}
+
+// linkedAccounts caches accounts of clients for apiKeyTTL
+var linkedAccounts = struct {
+	sync.Mutex
+	m map[string]linkedAccountsEntry
+}{m: make(map[string]linkedAccountsEntry)}
+
+type linkedAccountsEntry struct {
+	accounts []account
+	loaded   time.Time
+}
+
+// accountsOf returns the accounts linked to client, without the primary one
+func accountsOf(client string) ([]account, error) {
+	linkedAccounts.Lock()
+	e, ok := linkedAccounts.m[client]
+	linkedAccounts.Unlock()
+	if ok && time.Since(e.loaded) < apiKeyTTL {
+		return e.accounts, nil
+	}
+	data, err := persistense.Query(`SELECT `+accountColumns+` FROM extend_accounts WHERE client_id=$1
+		ORDER BY linked_at, id`, client)
+	if err != nil {
+		return nil, err
+	}
+	e = linkedAccountsEntry{accounts: make([]account, len(data)), loaded: time.Now()}
+	for i, row := range data {
+		e.accounts[i] = accountFromRow(row)
+	}
+	linkedAccounts.Lock()
+	linkedAccounts.m[client] = e
+	linkedAccounts.Unlock()
+	return e.accounts, nil
+}
+
+// accountIds returns the primary account followed by the accounts linked to client
+func accountIds(client string) ([]string, error) {
+	linked, err := accountsOf(client)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{primaryAccount}
+	for _, a := range linked {
+		ids = append(ids, a.Id)
+	}
+	return ids, nil
+}
+
+// forgetAccounts drops cached accounts of client, their sessions and card owners
+func forgetAccounts(client string) {
+	linkedAccounts.Lock()
+	delete(linkedAccounts.m, client)
+	linkedAccounts.Unlock()
+	cardOwners.Lock()
+	for k := range cardOwners.m {
+		if k.client == client {
+			delete(cardOwners.m, k)
+		}
+	}
+	cardOwners.Unlock()
+}
+
+// accountLogin returns the Extend login of account of k
+func accountLogin(k clientKey, acct string) (string, string, error) {
+	var data [][]string
+	var err error
+	if acct == primaryAccount {
+		data, err = persistense.Query("SELECT email, password FROM clients WHERE api_key=$1", k.Key)
+	} else {
+		data, err = persistense.Query("SELECT email, password FROM extend_accounts WHERE id=$1 AND client_id=$2",
+			acct, k.Client)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("account '%s' is not found: %s", acct, err)
+	}
+	if len(data) == 0 {
+		return "", "", fmt.Errorf("account '%s' is not found", acct)
+	}
+	return data[0][0], data[0][1], nil
+}
+
+type cardOwner struct{ client, card string }
+
+// cardOwners remembers which account of a client every listed card belongs to
+var cardOwners = struct {
+	sync.RWMutex
+	m map[cardOwner]string
+}{m: make(map[cardOwner]string)}
+
+func ownerOf(client, card string) (string, bool) {
+	cardOwners.RLock()
+	defer cardOwners.RUnlock()
+	acct, ok := cardOwners.m[cardOwner{client, card}]
+	return acct, ok
+}
+
+// fetchAllCards lists cards of every account of the client of apiKey concurrently, every card is tagged with
+// its account; accounts that failed are returned along with cards of the others, the error is set only
+// when all of them failed
+func fetchAllCards(apiKey string) ([]card, []string, error) {
+	k, err := lookupKey(strings.TrimSpace(apiKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := accountIds(k.Client)
+	if err != nil {
+		return nil, nil, err
+	}
+	type result struct {
+		cards []card
+		err   error
+	}
+	results := make([]result, len(ids))
+	var wg sync.WaitGroup
+	for i, acct := range ids {
+		wg.Add(1)
+		go func(i int, acct string) {
+			defer wg.Done()
+			t, err := accountSession(apiKey, acct)
+			if err == nil {
+				results[i].cards, err = fetchCards(t.Token)
+			}
+			results[i].err = err
+		}(i, acct)
+	}
+	wg.Wait()
+	cards, failed := make([]card, 0), []string{}
+	cardOwners.Lock()
+	for i, r := range results {
+		if r.err != nil {
+			log.Printf("account %s of %s: %v", ids[i], k.Client, r.err)
+			failed = append(failed, ids[i])
+			continue
+		}
+		for _, c := range r.cards {
+			c.Account = ids[i]
+			cardOwners.m[cardOwner{k.Client, c.Id}] = ids[i]
+			cards = append(cards, c)
+		}
+	}
+	cardOwners.Unlock()
+	if len(failed) == len(ids) {
+		return nil, failed, results[0].err
+	}
+	return cards, failed, nil
+}
+
+// cardSession returns the Extend session of apiKey for the account card belongs to; clients without linked
+// accounts, an empty or unknown card get the primary session
+func cardSession(apiKey, card string) (token, error) {
+	if card == "" {
+		return session(apiKey)
+	}
+	k, err := lookupKey(strings.TrimSpace(apiKey))
+	if err != nil {
+		return token{}, err
+	}
+	if linked, err := accountsOf(k.Client); err != nil || len(linked) == 0 {
+		return session(apiKey)
+	}
+	acct, ok := ownerOf(k.Client, card)
+	if !ok {
+		if _, _, err := fetchAllCards(apiKey); err != nil {
+			return token{}, err
+		}
+		if acct, ok = ownerOf(k.Client, card); !ok {
+			acct = primaryAccount
+		}
+	}
+	return accountSession(apiKey, acct)
+}
+
+// verifyCard confirms with Extend that card is visible to the session of apiKey; ledger rows, events, receipts and
+// statements are stored by card id only, so they are served after this check
+func verifyCard(apiKey, card string) (token, error) {
+	t, err := cardSession(apiKey, card)
+	if err != nil {
+		return t, err
+	}
+	g, err := fetchRawCard(t.Token, card)
+	if err != nil {
+		return t, err
+	}
+	if g.StringOrEmpty("id") != card {
+		return t, fmt.Errorf("card '%s' is not found", card)
+	}
+	return t, nil
+}
+
+// fetchTransactionOf looks transaction id up in every account of the client of apiKey, the primary one first
+func fetchTransactionOf(apiKey, id string) (gjson.GenJson, error) {
+	k, err := lookupKey(strings.TrimSpace(apiKey))
+	if err != nil {
+		return gjson.FromGeneric(nil), err
+	}
+	ids, err := accountIds(k.Client)
+	if err != nil {
+		return gjson.FromGeneric(nil), err
+	}
+	var g gjson.GenJson
+	for _, acct := range ids {
+		var t token
+		if t, err = accountSession(apiKey, acct); err != nil {
+			continue
+		}
+		if g, err = fetchTransaction(t.Token, id); err == nil && g.StringOrEmpty("id") != "" {
+			return g, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("transaction '%s' is not found", id)
+	}
+	return gjson.FromGeneric(nil), err
+}
+
+// keyAccount is an account background jobs sign in to with an API-Key
+type keyAccount struct{ Key, Account string }
+
+// keyAccounts returns the primary account of every key and the linked accounts of their clients once
+func keyAccounts(keys []string) []keyAccount {
+	retval, seen := []keyAccount{}, map[string]bool{}
+	for _, key := range keys {
+		retval = append(retval, keyAccount{key, primaryAccount})
+		k, err := lookupKey(key)
+		if err != nil {
+			continue
+		}
+		linked, err := accountsOf(k.Client)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, a := range linked {
+			if !seen[a.Id] {
+				seen[a.Id] = true
+				retval = append(retval, keyAccount{key, a.Id})
+			}
+		}
+	}
+	return retval
+}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/accounts
+[{"Id": "primary", "Label": "primary", "Email": "jane@example.com", ...}, {"Id": "3f2a...", "Label": "travel", ...}]
+*/
+func listAccounts(w http.ResponseWriter, req *http.Request) {
+	k, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	email, _, err := accountLogin(k, primaryAccount)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	linked, err := accountsOf(k.Client)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	render(w, req, append([]account{{Id: primaryAccount, Label: primaryAccount, Email: email, Linked: k.Issued}}, linked...))
+}
+
+type accountRequest struct {
+	Label    string
+	Email    string
+	Password string
+}
+
+/*
+	$ curl -X POST -H "API-Key: xxx" -d '{"Label": "travel", "Email": "travel@example.com", "Password": "***"}' \
+		http://localhost:8008/accounts
+
+{"Id": "3f2a...", "Label": "travel", "Email": "travel@example.com", "Linked": "2022-04-01T12:00:00Z"}
+*/
+func linkAccount(w http.ResponseWriter, req *http.Request) {
+	var ar accountRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&ar); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("cannot decode account: %v", err))
+		return
+	}
+	k, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	a, err := addAccount(k.Client, ar)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	renderStatus(w, req, http.StatusCreated, a)
+}
+
+// addAccount links an Extend login to client once it signs in successfully
+func addAccount(client string, ar accountRequest) (account, error) {
+	ar.Label, ar.Email = strings.TrimSpace(ar.Label), strings.TrimSpace(ar.Email)
+	if ar.Email == "" || ar.Password == "" {
+		return account{}, errors.New("Email and Password are required")
+	}
+	if ar.Label == "" {
+		ar.Label = ar.Email
+	}
+	if _, err := extendSignin(ar.Email, ar.Password, time.Now()); err != nil {
+		return account{}, fmt.Errorf("cannot sign in to Extend as '%s': %v", ar.Email, err)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return account{}, err
+	}
+	data, err := persistense.Query(`INSERT INTO extend_accounts(id, client_id, label, email, password, linked_at)
+		VALUES ($1, $2, $3, $4, $5, now()) RETURNING `+accountColumns, id, client, ar.Label, ar.Email, ar.Password)
+	if err != nil || len(data) == 0 {
+		return account{}, fmt.Errorf("cannot link account: %v", err)
+	}
+	forgetAccounts(client)
+	invalidateClient(client)
+	return accountFromRow(data[0]), nil
+}
+
+/*
+$ curl -X DELETE -H "API-Key: xxx" http://localhost:8008/accounts/3f2a...
+*/
+func unlinkAccount(w http.ResponseWriter, req *http.Request) {
+	k, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	id := mux.Vars(req)["account"]
+	data, err := persistense.Query(`DELETE FROM extend_accounts WHERE id=$1 AND client_id=$2 RETURNING id`, id, k.Client)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if len(data) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("account is not found"))
+		return
+	}
+	forgetAccounts(k.Client)
+	invalidateClient(k.Client)
+	cacheMu.Lock()
+	for sk := range cache {
+		if sk.account == id {
+			delete(cache, sk)
+		}
+	}
+	cacheMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// invalidateClient drops cached responses of every API-Key of client, their card lists change with accounts
+func invalidateClient(client string) {
+	data, err := persistense.Query(`SELECT api_key FROM clients WHERE `+clientIdColumn+`=$1`, client)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, row := range data {
+		invalidateKey(row[0])
+	}
+}
+
+var accountCommands = map[string]command{
+	"link":   {"-client id -email e -password p [-label l]", accountLink},
+	"list":   {"-client id", accountList},
+	"unlink": {"-client id account...", accountUnlink},
+}
+
+func accountLink(args []string) error {
+	fs := flag.NewFlagSet("account link", flag.ContinueOnError)
+	client := fs.String("client", "", "client id the account is linked to")
+	label := fs.String("label", "", "account label, the email by default")
+	email := fs.String("email", "", "Extend user email")
+	password := fs.String("password", os.Getenv("EXTEND_PASSWORD"), "Extend user password, EXTEND_PASSWORD by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *client == "" {
+		return errors.New("-client is required")
+	}
+	persistense.Initialize()
+	a, err := addAccount(*client, accountRequest{Label: *label, Email: *email, Password: *password})
+	if err != nil {
+		return err
+	}
+	fmt.Println(a.Id)
+	return nil
+}
+
+func accountList(args []string) error {
+	fs := flag.NewFlagSet("account list", flag.ContinueOnError)
+	client := fs.String("client", "", "client id")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *client == "" {
+		return errors.New("-client is required")
+	}
+	persistense.Initialize()
+	linked, err := accountsOf(*client)
+	if err != nil {
+		return err
+	}
+	for _, a := range linked {
+		fmt.Printf("%s\t%s\t%s\t%s\n", a.Id, a.Label, a.Email, timeOrDash(a.Linked))
+	}
+	return nil
+}
+
+func accountUnlink(args []string) error {
+	fs := flag.NewFlagSet("account unlink", flag.ContinueOnError)
+	client := fs.String("client", "", "client id")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *client == "" || fs.NArg() == 0 {
+		return errors.New("-client and accounts to unlink are expected")
+	}
+	persistense.Initialize()
+	for _, id := range fs.Args() {
+		data, err := persistense.Query(`DELETE FROM extend_accounts WHERE id=$1 AND client_id=$2 RETURNING id`, id, *client)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("account '%s' of '%s' is not found", id, *client)
+		}
+		fmt.Printf("%s unlinked, running services notice it within %s\n", id, apiKeyTTL)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCardSession(t *testing.T) {
+	now := time.Now()
+	keyCache.Lock()
+	keyCache.m["k1"] = clientKey{Key: "k1", Client: "c1", loaded: now}
+	keyCache.Unlock()
+	linkedAccounts.Lock()
+	linkedAccounts.m["c1"] = linkedAccountsEntry{accounts: []account{{Id: "a2", Label: "travel"}}, loaded: now}
+	linkedAccounts.Unlock()
+	cardOwners.Lock()
+	cardOwners.m[cardOwner{"c1", "vc_2"}] = "a2"
+	cardOwners.Unlock()
+	fresh := extendClaims{Expires: now.Add(time.Hour)}
+	cacheMu.Lock()
+	cache[sessionKey{"k1", primaryAccount}] = token{Token: "t1", Claims: fresh, Account: primaryAccount, signedIn: now}
+	cache[sessionKey{"k1", "a2"}] = token{Token: "t2", Claims: fresh, Account: "a2", signedIn: now}
+	cacheMu.Unlock()
+	defer forgetAccounts("c1")
+	defer forgetKey("k1")
+
+	if tok, err := cardSession("k1", "vc_2"); err != nil || tok.Token != "t2" {
+		t.Errorf("card of the linked account should get its session, got %+v %v", tok, err)
+	}
+	if tok, err := cardSession("k1", ""); err != nil || tok.Token != "t1" {
+		t.Errorf("requests without a card should get the primary session, got %+v %v", tok, err)
+	}
+	if got := keyAccounts([]string{"k1", "k1"}); len(got) != 3 || got[1] != (keyAccount{"k1", "a2"}) {
+		t.Errorf("linked accounts should be listed once after the primary ones, got %v", got)
+	}
+
+	forgetAccounts("c1")
+	if _, ok := ownerOf("c1", "vc_2"); ok {
+		t.Error("card owners should be forgotten with the accounts")
+	}
+	forgetKey("k1")
+	cacheMu.Lock()
+	left := len(cache)
+	cacheMu.Unlock()
+	if left != 0 {
+		t.Errorf("sessions of every account should be forgotten with the key, %d left", left)
+	}
+}
+
+// withExtendSession caches a key of client with a fresh Extend session of its primary account, no linked
+// accounts, and points -extend-url to a fake Extend answering with extend; all of it is undone after the test
+func withExtendSession(t *testing.T, key, client string, p permissions, extend http.HandlerFunc) {
+	srv := httptest.NewServer(extend)
+	base := *extendBase
+	flag.Set("extend-url", srv.URL)
+	now := time.Now()
+	keyCache.Lock()
+	keyCache.m[key] = clientKey{Key: key, Client: client, permissions: p, loaded: now}
+	keyCache.Unlock()
+	linkedAccounts.Lock()
+	linkedAccounts.m[client] = linkedAccountsEntry{loaded: now}
+	linkedAccounts.Unlock()
+	cacheMu.Lock()
+	cache[sessionKey{key, primaryAccount}] = token{Token: "t-" + key, Claims: extendClaims{Expires: now.Add(time.Hour)}, signedIn: now}
+	cacheMu.Unlock()
+	t.Cleanup(func() {
+		forgetAccounts(client)
+		forgetKey(key)
+		flag.Set("extend-url", base)
+		srv.Close()
+	})
+}
+
+// extendCards is a fake Extend showing only cards to the session of key
+func extendCards(key string, cards ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, c := range cards {
+			if req.URL.Path == "/virtualcards/"+c && req.Header.Get("Authorization") == "Bearer t-"+key {
+				w.Write([]byte(`{"virtualCard": {"id": "` + c + `"}}`))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Not Found"}`))
+	}
+}
+
+func TestVerifyCard(t *testing.T) {
+	withExtendSession(t, "k1", "c1", permissions{}, extendCards("k1", "vc_1"))
+	if _, err := verifyCard("k1", "vc_1"); err != nil {
+		t.Errorf("own card should verify: %v", err)
+	}
+	if _, err := verifyCard("k1", "vc_other"); err == nil {
+		t.Error("card Extend does not show to the session should not verify")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// anomaly checks score every transaction a sync sees for the first time against the ledger of its card,
+// flagged transactions are stored in alerts table
+
+var (
+	anomalyChecks  = flag.String("anomaly-checks", "new-merchant,amount,declines,foreign-currency", "comma separated anomaly checks of new transactions, empty - none")
+	anomalySigma   = flag.Float64("anomaly-amount-sigma", 3, "amounts more than this many standard deviations above the card's mean are flagged")
+	anomalyHistory = flag.Int("anomaly-min-history", 5, "charges of a card needed before amounts are checked")
+	anomalyDecline = flag.Int("anomaly-declines", 3, "declines of a card within -anomaly-decline-window flagged as a burst")
+	declineWindow  = flag.Duration("anomaly-decline-window", time.Hour, "window of decline bursts")
+	homeCurrency   = flag.String("anomaly-currency", "USD", "charges in another merchant currency are flagged")
+)
+
+// kinds of anomaly flags
+const (
+	flagNewMerchant     = "NEW_MERCHANT"
+	flagAmountOutlier   = "AMOUNT_OUTLIER"
+	flagDeclineBurst    = "DECLINE_BURST"
+	flagForeignCurrency = "FOREIGN_CURRENCY"
+)
+
+// anomalyCheckNames maps -anomaly-checks names to the flags they raise
+var anomalyCheckNames = map[string]string{
+	"new-merchant":     flagNewMerchant,
+	"amount":           flagAmountOutlier,
+	"declines":         flagDeclineBurst,
+	"foreign-currency": flagForeignCurrency,
+}
+
+func enabledChecks(checks string) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	for _, name := range splitList(checks) {
+		kind, ok := anomalyCheckNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown anomaly check '%s'", name)
+		}
+		enabled[kind] = true
+	}
+	return enabled, nil
+}
+
+// txFlag is a reason a transaction looks unusual, Score adds up to the score of its alert
+type txFlag struct {
+	Kind   string
+	Detail string
+	Score  float64
+}
+
+// alert is a transaction with anomaly flags
+type alert struct {
+	Id             int64
+	Card           string
+	Transaction    string
+	At             time.Time
+	Score          float64
+	Flags          []txFlag
+	Acknowledged   *time.Time `json:",omitempty"`
+	AcknowledgedBy string     `json:",omitempty"`
+}
+
+// merchantCurrency returns the currency the merchant charged in, empty if Extend did not tell
+func merchantCurrency(g gjson.GenJson) string {
+	for _, field := range []string{"authMerchantCurrency", "merchantCurrency", "currency"} {
+		if c := g.StringOrEmpty(field); c != "" {
+			return strings.ToUpper(c)
+		}
+	}
+	return ""
+}
+
+// scoreTransaction checks current[i] against history, the ledger of the card before the sync, and against
+// declines among current, every transaction Extend returned
+func scoreTransaction(enabled map[string]bool, history map[string]tx, current []tx, raw []gjson.GenJson, i int) []txFlag {
+	t, g := current[i], raw[i]
+	flags := []txFlag{}
+	if enabled[flagNewMerchant] && t.Status != "DECLINED" {
+		key, seen := merchantKey(t.Name), false
+		for _, h := range history {
+			if merchantKey(h.Name) == key {
+				seen = true
+				break
+			}
+		}
+		if !seen && key != "" {
+			flags = append(flags, txFlag{flagNewMerchant, fmt.Sprintf("first charge by '%s'", t.Name), 1})
+		}
+	}
+	if enabled[flagAmountOutlier] && t.Amount > 0 {
+		amounts := []float64{}
+		for _, h := range history {
+			if h.Amount > 0 && h.Status != "DECLINED" && h.Status != "REVERSED" {
+				amounts = append(amounts, h.Amount)
+			}
+		}
+		if len(amounts) >= *anomalyHistory {
+			mean, sd := meanStddev(amounts)
+			if z := (t.Amount - mean) / math.Max(sd, 0.01); z > *anomalySigma {
+				flags = append(flags, txFlag{flagAmountOutlier,
+					fmt.Sprintf("%s is %.1f standard deviations above the mean %s", amountString(t.Amount), z, amountString(mean)),
+					math.Round(z*100) / 100})
+			}
+		}
+	}
+	if enabled[flagDeclineBurst] && t.Status == "DECLINED" {
+		if at, ok := txTime(t, g); ok {
+			declines := 0
+			for j, c := range current {
+				if c.Status != "DECLINED" {
+					continue
+				}
+				if cat, ok := txTime(c, raw[j]); ok && !cat.After(at) && at.Sub(cat) <= *declineWindow {
+					declines++
+				}
+			}
+			if declines >= *anomalyDecline {
+				flags = append(flags, txFlag{flagDeclineBurst, fmt.Sprintf("%d declines within %s", declines, *declineWindow),
+					float64(declines)})
+			}
+		}
+	}
+	if c := merchantCurrency(g); enabled[flagForeignCurrency] && *homeCurrency != "" && c != "" &&
+		!strings.EqualFold(c, *homeCurrency) {
+		flags = append(flags, txFlag{flagForeignCurrency, "charged in " + c, 1})
+	}
+	return flags
+}
+
+func meanStddev(values []float64) (float64, float64) {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
+
+// detectAnomalies scores transactions of card that are not in the ledger yet and stores flagged ones;
+// the first sync of a card has no history and is not scored
+func detectAnomalies(card string, known map[string]tx, current []tx, raw []gjson.GenJson) {
+	if known == nil {
+		return
+	}
+	enabled, err := enabledChecks(*anomalyChecks)
+	if err != nil || len(enabled) == 0 {
+		return
+	}
+	for i, t := range current {
+		if _, ok := known[t.Id]; ok {
+			continue
+		}
+		flags := scoreTransaction(enabled, known, current, raw, i)
+		if len(flags) == 0 {
+			continue
+		}
+		if err := storeAlert(card, t.Id, flags); err != nil {
+			log.Println(err)
+		} else {
+			log.Printf("alert for transaction '%s' of card '%s': %d flags", t.Id, card, len(flags))
+		}
+	}
+}
+
+func storeAlert(card, id string, flags []txFlag) error {
+	score := 0.0
+	for _, f := range flags {
+		score += f.Score
+	}
+	b, _ := json.Marshal(flags)
+	return persistense.Exec(`INSERT INTO alerts(card, tx_id, at, score, flags) VALUES ($1, $2, now(), $3, $4)
+		ON CONFLICT (tx_id) DO NOTHING`, card, id, score, string(b))
+}
+
+const alertColumns = `id, card, tx_id, (EXTRACT(EPOCH FROM at)*1000)::bigint, score, flags::text,
+	COALESCE((EXTRACT(EPOCH FROM acknowledged_at)*1000)::bigint, 0), acknowledged_by`
+
+func alertFromRow(row []string) *alert {
+	a := &alert{Card: row[1], Transaction: row[2], Flags: []txFlag{}, AcknowledgedBy: row[7]}
+	a.Id, _ = strconv.ParseInt(row[0], 10, 64)
+	ms, _ := strconv.ParseInt(row[3], 10, 64)
+	a.At = time.Unix(0, ms*int64(time.Millisecond)).UTC()
+	a.Score, _ = strconv.ParseFloat(row[4], 64)
+	if err := json.Unmarshal([]byte(row[5]), &a.Flags); err != nil {
+		log.Println(err)
+	}
+	if ms, _ := strconv.ParseInt(row[6], 10, 64); ms > 0 {
+		at := time.Unix(0, ms*int64(time.Millisecond)).UTC()
+		a.Acknowledged = &at
+	}
+	return a
+}
+
+// withAlerts attaches alerts of card to txs
+func withAlerts(card string, txs []tx) []tx {
+	data, err := persistense.Query(`SELECT `+alertColumns+` FROM alerts WHERE card=$1`, card)
+	if err != nil {
+		log.Println(err)
+		return txs
+	}
+	alerts := make(map[string]*alert, len(data))
+	for _, row := range data {
+		a := alertFromRow(row)
+		alerts[a.Transaction] = a
+	}
+	for i := range txs {
+		txs[i].Alert = alerts[txs[i].Id]
+	}
+	return txs
+}
+
+func transactionAlert(id string) (*alert, error) {
+	data, err := persistense.Query(`SELECT `+alertColumns+` FROM alerts WHERE tx_id=$1`, id)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	return alertFromRow(data[0]), nil
+}
+
+/*
+$ curl -H "API-Key: xxx" "http://localhost:8008/alerts?card=XXX&min-score=2&acknowledged=false"
+[{"Id": 3, "Card": "XXX", "Transaction": "YYY", "Score": 4.2, "Flags": [{"Kind": "AMOUNT_OUTLIER", ...}], ...}]
+*/
+func listAlerts(w http.ResponseWriter, req *http.Request) {
+	q, p := req.URL.Query(), permissionsFrom(req)
+	where, params := []string{"true"}, []interface{}{}
+	if card := q.Get("card"); card != "" {
+		if !p.allowsCard(card) {
+			log.Printf("api-Key has no access to card '%s'", card)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		params = append(params, card)
+		where = append(where, fmt.Sprintf("card=$%d", len(params)))
+	}
+	if v := q.Get("min-score"); v != "" {
+		score, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("min-score: %v", err))
+			return
+		}
+		params = append(params, score)
+		where = append(where, fmt.Sprintf("score>=$%d", len(params)))
+	}
+	if v := q.Get("acknowledged"); v != "" {
+		ack, err := strconv.ParseBool(v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("acknowledged: %v", err))
+			return
+		}
+		if ack {
+			where = append(where, "acknowledged_at IS NOT NULL")
+		} else {
+			where = append(where, "acknowledged_at IS NULL")
+		}
+	}
+	if v := q.Get("kind"); v != "" {
+		b, _ := json.Marshal([]map[string]string{{"Kind": v}})
+		params = append(params, string(b))
+		where = append(where, fmt.Sprintf("flags @> $%d::jsonb", len(params)))
+	}
+	cards, _, err := fetchAllCards(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ids := []string{}
+	for _, c := range cards {
+		if p.allowsCard(c.Id) {
+			ids = append(ids, c.Id)
+		}
+	}
+	params = append(params, strings.Join(ids, ","))
+	where = append(where, fmt.Sprintf("card=ANY(string_to_array($%d, ','))", len(params)))
+	data, err := persistense.Query(`SELECT `+alertColumns+` FROM alerts WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY at DESC, id DESC LIMIT 1000`, params...)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	retval := make([]*alert, len(data))
+	for i, row := range data {
+		retval[i] = alertFromRow(row)
+	}
+	render(w, req, retval)
+}
+
+/*
+$ curl -X POST -H "API-Key: xxx" http://localhost:8008/alerts/3/acknowledge
+{"Id": 3, "Acknowledged": "2022-04-01T12:00:00Z", "AcknowledgedBy": "acme", ...}
+*/
+func acknowledgeAlert(w http.ResponseWriter, req *http.Request) {
+	data, err := persistense.Query(`SELECT `+alertColumns+` FROM alerts WHERE id=$1`, mux.Vars(req)["alert"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if len(data) == 0 || !permissionsFrom(req).allowsCard(data[0][1]) {
+		httpError(w, http.StatusNotFound, errors.New("alert is not found"))
+		return
+	}
+	t, err := cardSession(requestKey(req), data[0][1])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// the card should be the caller's, Extend answers only about cards of the signed in user
+	if g, err := fetchTransaction(t.Token, data[0][2]); err != nil || g.StringOrEmpty("virtualCardId") != data[0][1] {
+		httpError(w, http.StatusNotFound, errors.New("alert is not found"))
+		return
+	}
+	client := ""
+	if k, err := lookupKey(requestKey(req)); err == nil {
+		client = k.Client
+	}
+	if data, err = persistense.Query(`UPDATE alerts SET acknowledged_at=COALESCE(acknowledged_at, now()),
+		acknowledged_by=CASE WHEN acknowledged_at IS NULL THEN $2 ELSE acknowledged_by END WHERE id=$1
+		RETURNING `+alertColumns, mux.Vars(req)["alert"], client); err != nil || len(data) == 0 {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	invalidateCard(data[0][1])
+	render(w, req, alertFromRow(data[0]))
+}
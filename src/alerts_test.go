@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestScoreTransaction(t *testing.T) {
+	current, raw := rawTxs(t, `[
+		{"id": "h1", "merchantName": "Uber", "authBillingAmountCents": 1000, "status": "CLEARED", "authedAt": "2021-03-01T10:00:00Z"},
+		{"id": "h2", "merchantName": "Uber", "authBillingAmountCents": 1200, "status": "CLEARED", "authedAt": "2021-03-02T10:00:00Z"},
+		{"id": "h3", "merchantName": "Uber", "authBillingAmountCents": 1100, "status": "CLEARED", "authedAt": "2021-03-03T10:00:00Z"},
+		{"id": "h4", "merchantName": "Lyft", "authBillingAmountCents": 900, "status": "CLEARED", "authedAt": "2021-03-04T10:00:00Z"},
+		{"id": "h5", "merchantName": "Lyft", "authBillingAmountCents": 1000, "status": "CLEARED", "authedAt": "2021-03-05T10:00:00Z"},
+		{"id": "big", "merchantName": "Uber", "authBillingAmountCents": 50000, "status": "PENDING", "authedAt": "2021-03-06T10:00:00Z"},
+		{"id": "abroad", "merchantName": "Hotel Paris", "authBillingAmountCents": 1000, "status": "PENDING",
+			"authMerchantCurrency": "eur", "authedAt": "2021-03-06T11:00:00Z"},
+		{"id": "d1", "merchantName": "Shop", "authBillingAmountCents": 1000, "status": "DECLINED", "authedAt": "2021-03-06T12:00:00Z"},
+		{"id": "d2", "merchantName": "Shop", "authBillingAmountCents": 1000, "status": "DECLINED", "authedAt": "2021-03-06T12:10:00Z"},
+		{"id": "d3", "merchantName": "Shop", "authBillingAmountCents": 1000, "status": "DECLINED", "authedAt": "2021-03-06T12:20:00Z"}]`)
+	history := map[string]tx{}
+	for _, h := range current[:5] {
+		history[h.Id] = h
+	}
+	enabled, err := enabledChecks(*anomalyChecks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := func(i int) map[string]bool {
+		retval := map[string]bool{}
+		for _, f := range scoreTransaction(enabled, history, current, raw, i) {
+			retval[f.Kind] = true
+		}
+		return retval
+	}
+	if k := kinds(5); len(k) != 1 || !k[flagAmountOutlier] {
+		t.Errorf("big charge of a known merchant should be an amount outlier only, got %v", k)
+	}
+	if k := kinds(6); len(k) != 2 || !k[flagNewMerchant] || !k[flagForeignCurrency] {
+		t.Errorf("charge in euro by a new merchant expected, got %v", k)
+	}
+	if k := kinds(8); len(k) != 0 {
+		t.Errorf("two declines are not a burst yet, got %v", k)
+	}
+	if k := kinds(9); len(k) != 1 || !k[flagDeclineBurst] {
+		t.Errorf("third decline within the window should be a burst, got %v", k)
+	}
+	if _, err := enabledChecks("amount,unknown"); err == nil {
+		t.Error("unknown checks should be rejected")
+	}
+	enabled, _ = enabledChecks("declines")
+	if k := kinds(6); len(k) != 0 {
+		t.Errorf("only enabled checks should flag, got %v", k)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// annotation is local bookkeeping data of a transaction Extend knows nothing about
+type annotation struct {
+	Project   string   `json:",omitempty"`
+	GLAccount string   `json:",omitempty"`
+	Category  string   `json:",omitempty"`
+	Note      string   `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+
+	source string // client that stored the annotation or rule:<id> of the rule that assigned it
+}
+
+func (a *annotation) normalize() {
+	a.Project, a.GLAccount, a.Category = strings.TrimSpace(a.Project), strings.TrimSpace(a.GLAccount), strings.TrimSpace(a.Category)
+	tags := make([]string, 0, len(a.Tags))
+	for _, t := range a.Tags {
+		if t = strings.ToLower(strings.TrimSpace(strings.ReplaceAll(t, ",", " "))); t != "" && !contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	a.Tags = tags
+}
+
+func (a *annotation) hasTags(tags []string) bool {
+	for _, t := range tags {
+		if a == nil || !contains(a.Tags, strings.ToLower(t)) {
+			return false
+		}
+	}
+	return true
+}
+
+const annotationColumns = "tx_id, project, gl_account, category, note, tags, updated_by"
+
+func annotationFromRow(row []string) *annotation {
+	return &annotation{Project: row[1], GLAccount: row[2], Category: row[3], Note: row[4], Tags: splitList(row[5]),
+		source: row[6]}
+}
+
+// cardAnnotations returns annotations of the transactions of card by transaction id
+func cardAnnotations(card string) (map[string]*annotation, error) {
+	data, err := persistense.Query(`SELECT `+annotationColumns+` FROM annotations WHERE card=$1`, card)
+	if err != nil {
+		return nil, err
+	}
+	retval := make(map[string]*annotation, len(data))
+	for _, row := range data {
+		retval[row[0]] = annotationFromRow(row)
+	}
+	return retval, nil
+}
+
+func transactionAnnotation(id string) (*annotation, error) {
+	data, err := persistense.Query(`SELECT `+annotationColumns+` FROM annotations WHERE tx_id=$1`, id)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	return annotationFromRow(data[0]), nil
+}
+
+// annotate attaches annotations to txs and keeps only transactions with all tags and the category, if given
+func annotate(card string, txs []tx, tags []string, category string) []tx {
+	annotations, err := cardAnnotations(card)
+	if err != nil {
+		log.Println(err)
+	}
+	retval := make([]tx, 0, len(txs))
+	for _, t := range txs {
+		t.Annotation = annotations[t.Id]
+		if !t.Annotation.hasTags(tags) {
+			continue
+		}
+		if category != "" && (t.Annotation == nil || !strings.EqualFold(t.Annotation.Category, category)) {
+			continue
+		}
+		retval = append(retval, t)
+	}
+	return retval
+}
+
+func saveAnnotation(card, id, client string, a annotation) error {
+	return persistense.Exec(`INSERT INTO annotations(tx_id, card, project, gl_account, category, note, tags, updated_at, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now(), $8)
+		ON CONFLICT (tx_id) DO UPDATE SET project=$3, gl_account=$4, category=$5, note=$6, tags=$7, updated_at=now(), updated_by=$8`,
+		id, card, a.Project, a.GLAccount, a.Category, a.Note, strings.Join(a.Tags, ","), client)
+}
+
+/*
+	$ curl -X PUT -H "API-Key: xxx" -d '{"Project": "P-1", "GLAccount": "6100", "Category": "Travel", "Tags": ["client-x"]}' \
+		http://localhost:8008/cards/XXX/transactions/YYY/annotations
+
+{"Project": "P-1", ...}
+*/
+func putAnnotation(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	var a annotation
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&a); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("cannot decode annotation: %v", err))
+		return
+	}
+	a.normalize()
+	tok, err := signin(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if g, err := fetchTransaction(tok, params["transaction"]); err != nil {
+		log.Println(err)
+		httpError(w, http.StatusNotFound, errors.New("transaction is not found"))
+		return
+	} else if g.StringOrEmpty("virtualCardId") != params["card"] {
+		httpError(w, http.StatusNotFound, errors.New("transaction does not belong to the card"))
+		return
+	}
+	client := ""
+	if k, err := lookupKey(requestKey(req)); err == nil {
+		client = k.Client
+	}
+	if err := saveAnnotation(params["card"], params["transaction"], client, a); err != nil {
+		log.Println(err)
+		httpError(w, http.StatusInternalServerError, errors.New("cannot store annotation"))
+		return
+	}
+	invalidateCard(params["card"])
+	render(w, req, a)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnnotationNormalize(t *testing.T) {
+	a := annotation{Project: " P-1 ", Tags: []string{"Client-X", " client-x", "a,b", "", "travel"}}
+	a.normalize()
+	if a.Project != "P-1" || !reflect.DeepEqual(a.Tags, []string{"client-x", "a b", "travel"}) {
+		t.Errorf("unexpected normalized annotation %+v", a)
+	}
+	if !a.hasTags([]string{"Travel", "client-x"}) || a.hasTags([]string{"travel", "other"}) {
+		t.Errorf("hasTags does not match tags %v", a.Tags)
+	}
+	var none *annotation
+	if !none.hasTags(nil) || none.hasTags([]string{"travel"}) {
+		t.Error("missing annotation should match only the empty tag filter")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var rotationGrace = flag.Duration("rotation-grace", 24*time.Hour, "how long the old API-Key stays valid after rotation")
+
+// clientKey is a row of clients table; keys sharing Client belong to the same consumer
+type clientKey struct {
+	permissions
+	Key     string
+	Client  string
+	Issued  time.Time
+	Expires time.Time // zero - never
+	Revoked time.Time // zero - not revoked
+	Flushed time.Time // Extend sessions signed in before are dropped
+	loaded  time.Time
+}
+
+// check returns an error if the key cannot be used at moment now
+func (k clientKey) check(now time.Time) error {
+	if !k.Revoked.IsZero() && !k.Revoked.After(now) {
+		return fmt.Errorf("api-Key was revoked at %s", k.Revoked.UTC().Format(time.RFC3339))
+	}
+	if !k.Expires.IsZero() && !k.Expires.After(now) {
+		return fmt.Errorf("api-Key has expired at %s", k.Expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+const apiKeyTTL = time.Minute
+
+var keyCache = struct {
+	sync.RWMutex
+	m map[string]clientKey
+}{m: make(map[string]clientKey)}
+
+// keys inserted by hand have no client_id and form a client of their own
+const clientIdColumn = "COALESCE(NULLIF(client_id, ''), api_key)"
+
+const apiKeyColumns = `api_key, ` + clientIdColumn + `, scopes, cards,
+	COALESCE(EXTRACT(EPOCH FROM issued_at)::bigint, 0),
+	COALESCE(EXTRACT(EPOCH FROM expires_at)::bigint, 0),
+	COALESCE(EXTRACT(EPOCH FROM revoked_at)::bigint, 0),
+	COALESCE(EXTRACT(EPOCH FROM tokens_flushed_at)::bigint, 0)`
+
+func clientKeyFromRow(row []string) clientKey {
+	return clientKey{
+		Key:         row[0],
+		Client:      row[1],
+		permissions: parsePermissions(row[2], row[3]),
+		Issued:      unixOrZero(row[4]),
+		Expires:     unixOrZero(row[5]),
+		Revoked:     unixOrZero(row[6]),
+		Flushed:     unixOrZero(row[7]),
+		loaded:      time.Now(),
+	}
+}
+
+func unixOrZero(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// lookupKey returns the clients row of apiKey, rows are cached for apiKeyTTL
+func lookupKey(apiKey string) (clientKey, error) {
+	keyCache.RLock()
+	k, ok := keyCache.m[apiKey]
+	keyCache.RUnlock()
+	if ok && time.Since(k.loaded) < apiKeyTTL {
+		return k, nil
+	}
+	data, err := persistense.Query("SELECT "+apiKeyColumns+" FROM clients WHERE api_key=$1", apiKey)
+	if err != nil {
+		return k, fmt.Errorf("api-Key is not found: %s", err)
+	}
+	if len(data) == 0 {
+		return k, errors.New("api-Key is not found")
+	}
+	k = clientKeyFromRow(data[0])
+	keyCache.Lock()
+	keyCache.m[apiKey] = k
+	keyCache.Unlock()
+	return k, nil
+}
+
+func forgetKey(apiKey string) {
+	keyCache.Lock()
+	delete(keyCache.m, apiKey)
+	keyCache.Unlock()
+	cacheMu.Lock()
+	for k := range cache {
+		if k.apiKey == apiKey {
+			delete(cache, k)
+		}
+	}
+	cacheMu.Unlock()
+	invalidateKey(apiKey)
+}
+
+func newKey() (string, error) { return randomHex(32) }
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// last usage of keys is collected in memory and written to clients table by flushLastUsed
+var lastUsed = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+func touch(apiKey string) {
+	lastUsed.Lock()
+	lastUsed.m[apiKey] = time.Now()
+	lastUsed.Unlock()
+}
+
+func flushLastUsed(every time.Duration) {
+	for range time.Tick(every) {
+		lastUsed.Lock()
+		batch := lastUsed.m
+		lastUsed.m = make(map[string]time.Time)
+		lastUsed.Unlock()
+		for key, t := range batch {
+			sqlerr(persistense.Exec("UPDATE clients SET last_used_at=to_timestamp($1) WHERE api_key=$2", t.Unix(), key))
+		}
+	}
+}
+
+// rotatedColumns carry the settings of a key over to the key replacing it; the other columns of clients
+// (key, client, issue, expiry, revocation and last use times, flushed sessions, replacement) describe the key itself
+const rotatedColumns = "email, password, scopes, cards, jwt_subject"
+
+type keyView struct {
+	ApiKey          string
+	Issued          string
+	PreviousExpires string
+}
+
+/*
+$ curl -X POST -H "API-Key: xxx" http://localhost:8008/keys/rotate
+{"ApiKey": "yyy", "Issued": "2022-04-01T12:00:00Z", "PreviousExpires": "2022-04-02T12:00:00Z"}
+*/
+func rotateKey(w http.ResponseWriter, req *http.Request) {
+	old, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	key, err := newKey()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	previousExpires := now.Add(*rotationGrace)
+	if !old.Expires.IsZero() && old.Expires.Before(previousExpires) {
+		previousExpires = old.Expires
+	}
+	// the calling key is marked replaced first, so a key rotates once and its siblings are left alone
+	data, err := persistense.Query(`UPDATE clients SET replaced_by=$1, expires_at=to_timestamp($2)
+		WHERE api_key=$3 AND replaced_by='' RETURNING api_key`, key, previousExpires.Unix(), old.Key)
+	if err == nil && len(data) == 0 {
+		httpError(w, http.StatusConflict, errors.New("api-Key was already rotated, use the new one"))
+		return
+	}
+	if err == nil {
+		err = persistense.Exec(`INSERT INTO clients(api_key, client_id, issued_at, `+rotatedColumns+`)
+			SELECT $1, $2, now(), `+rotatedColumns+` FROM clients WHERE api_key=$3`, key, old.Client, old.Key)
+		if err != nil {
+			var expires interface{} // NULL - never
+			if !old.Expires.IsZero() {
+				expires = old.Expires
+			}
+			sqlerr(persistense.Exec("UPDATE clients SET replaced_by='', expires_at=$1 WHERE api_key=$2", expires, old.Key))
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		httpError(w, http.StatusInternalServerError, errors.New("cannot rotate api-Key"))
+		return
+	}
+	forgetKey(old.Key)
+	render(w, req, keyView{
+		ApiKey:          key,
+		Issued:          now.UTC().Format(time.RFC3339),
+		PreviousExpires: previousExpires.UTC().Format(time.RFC3339),
+	})
+}
+
+// canRevoke reports whether k may revoke target of its client: its own key, a key it could have been limited to,
+// i.e. with no scope and no card k lacks, or any key with the admin scope
+func (k clientKey) canRevoke(target clientKey) bool {
+	if target.Client != k.Client {
+		return false
+	}
+	if target.Key == k.Key || k.allows(scopeAdmin) {
+		return true
+	}
+	for _, s := range target.Scopes {
+		if !k.allows(s) {
+			return false
+		}
+	}
+	if !target.restricted() {
+		return !k.restricted()
+	}
+	for _, c := range target.Cards {
+		if !k.allowsCard(c) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+$ curl -X DELETE -H "API-Key: xxx" http://localhost:8008/keys/yyy
+*/
+func revokeKey(w http.ResponseWriter, req *http.Request) {
+	caller, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	target := mux.Vars(req)["key"]
+	if k, err := lookupKey(target); err != nil || k.Client != caller.Client {
+		httpError(w, http.StatusNotFound, errors.New("api-Key is not found"))
+		return
+	} else if !caller.canRevoke(k) {
+		httpError(w, http.StatusForbidden, errors.New("api-Key may only revoke keys with no more scopes and cards than its own"))
+		return
+	}
+	if err := persistense.Exec("UPDATE clients SET revoked_at=now() WHERE api_key=$1 AND revoked_at IS NULL", target); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	forgetKey(target)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatedColumns(t *testing.T) {
+	ownColumns := map[string]bool{"api_key": true, "client_id": true, "issued_at": true, "expires_at": true,
+		"revoked_at": true, "last_used_at": true, "tokens_flushed_at": true, "replaced_by": true}
+	rotated := map[string]bool{}
+	for _, c := range strings.Split(rotatedColumns, ",") {
+		rotated[strings.TrimSpace(c)] = true
+	}
+	columns := clientsTable[strings.Index(clientsTable, "(")+1 : strings.Index(clientsTable, "PRIMARY KEY")]
+	for _, c := range strings.Split(columns, ",") {
+		if name := strings.Fields(c); len(name) > 0 && !ownColumns[name[0]] && !rotated[name[0]] {
+			t.Errorf("column '%s' of clients is not copied to rotated keys", name[0])
+		}
+	}
+}
+
+// hs256 returns a bearer token signed with secret
+func hs256(secret string, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	input := segment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(claims)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// TestRotateBearerKey needs a database, DBHOST and the other DB* variables select it
+func TestRotateBearerKey(t *testing.T) {
+	if os.Getenv("DBHOST") == "" {
+		t.Skip("DBHOST is not set")
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	persistense.Initialize()
+	migrate()
+	suffix := strings.ReplaceAll(time.Now().UTC().Format("150405.000000"), ".", "")
+	oldKey, subject := "rotate-test-"+suffix, "rotate-subject-"+suffix
+	if err := persistense.Exec(`INSERT INTO clients(api_key, client_id, email, password, jwt_subject)
+		VALUES ($1, $1, 'user@example.com', 'secret', $2)`, oldKey, subject); err != nil {
+		t.Fatal(err)
+	}
+	defer persistense.Exec("DELETE FROM clients WHERE jwt_subject=$1", subject)
+	siblingKey := "rotate-sibling-" + suffix
+	if err := persistense.Exec(`INSERT INTO clients(api_key, client_id, email, password, cards)
+		VALUES ($1, $2, 'user@example.com', 'secret', 'vc_1')`, siblingKey, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	defer persistense.Exec("DELETE FROM clients WHERE api_key=$1", siblingKey)
+	idpKeys.Add("", []byte("rotate-test-secret"))
+	bearer := "Bearer " + hs256("rotate-test-secret", map[string]interface{}{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()})
+
+	req := httptest.NewRequest(http.MethodPost, "/keys/rotate", nil)
+	req.Header.Set("API-Key", oldKey)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	var rotated keyView
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &rotated) != nil {
+		t.Fatalf("rotation failed: %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("a rotated key should not rotate again, got %d %s", rec.Code, rec.Body)
+	}
+	if data, err := persistense.Query("SELECT revoked_at IS NULL FROM clients WHERE api_key=$1", siblingKey); err != nil ||
+		len(data) == 0 || data[0][0] != "true" {
+		t.Errorf("rotation should leave other keys of the client alone, got %v (%v)", data, err)
+	}
+	// the grace period of the old key is over
+	if err := persistense.Exec("UPDATE clients SET expires_at=now()-interval '1 second' WHERE api_key=$1", oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := credentials("", bearer); err != nil || key != rotated.ApiKey {
+		t.Errorf("bearer token should authenticate as the new key %s, got '%s' (%v)", rotated.ApiKey, key, err)
+	}
+}
+
+func TestCanRevoke(t *testing.T) {
+	key := func(name, client, scopes, cards string) clientKey {
+		return clientKey{Key: name, Client: client, permissions: parsePermissions(scopes, cards)}
+	}
+	full, restricted := key("full", "acme", "*", ""), key("restricted", "acme", "cards:read", "vc_1")
+	admin := key("admin", "acme", "admin", "vc_1")
+	for _, c := range []struct {
+		caller, target clientKey
+		allowed        bool
+	}{
+		{restricted, restricted, true},
+		{restricted, full, false},
+		{restricted, key("other-card", "acme", "cards:read", "vc_2"), false},
+		{restricted, key("every-card", "acme", "cards:read", ""), false},
+		{full, restricted, true},
+		{full, admin, false},
+		{admin, full, true},
+		{full, key("foreign", "other", "cards:read", ""), false},
+	} {
+		if allowed := c.caller.canRevoke(c.target); allowed != c.allowed {
+			t.Errorf("%s revoking %s: expected %v, got %v", c.caller.Key, c.target.Key, c.allowed, allowed)
+		}
+	}
+}
+
+func TestRestrictedKeyRevokesFullKey(t *testing.T) {
+	now := time.Now()
+	keyCache.Lock()
+	keyCache.m["k5"] = clientKey{Key: "k5", Client: "c5", permissions: parsePermissions("cards:read", "vc_1"), loaded: now}
+	keyCache.m["k6"] = clientKey{Key: "k6", Client: "c5", permissions: parsePermissions("*", ""), loaded: now}
+	keyCache.Unlock()
+	defer forgetKey("k5")
+	defer forgetKey("k6")
+	req := httptest.NewRequest(http.MethodDelete, "/keys/k6", nil)
+	req.Header.Set("API-Key", "k5")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("a restricted key should not revoke a full key, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	auditBatch        = flag.Int("audit-batch", 100, "max rows per audit insert")
+	auditQueueTimeout = flag.Duration("audit-queue-timeout", time.Second, "how long a request waits for room in the full audit queue before its entry goes to -audit-fallback")
+	auditFallback     = flag.String("audit-fallback", "", "json lines file of audit entries that could not be queued or inserted, default <r>/audit-fallback.jsonl")
+)
+
+// auditEntry describes a single API access, it is filled while the request is served
+type auditEntry struct {
+	At          time.Time
+	KeyPrefix   string
+	Client      string
+	Method      string
+	Route       string
+	Card        string `json:",omitempty"`
+	Transaction string `json:",omitempty"`
+	Status      int
+	LatencyMs   int64
+	ClientIP    string
+}
+
+var auditQueue = make(chan auditEntry, 4096)
+
+// auditStats are published at /metrics: entries written to -audit-fallback and entries lost altogether
+var auditStats = expvar.NewMap("audit")
+
+// queueAuditEntry queues e for flushAudit; when the queue stays full for -audit-queue-timeout the entry is
+// appended to -audit-fallback instead, an audit entry is never dropped silently
+func queueAuditEntry(e auditEntry) {
+	select {
+	case auditQueue <- e:
+		return
+	default:
+	}
+	timer := time.NewTimer(*auditQueueTimeout)
+	defer timer.Stop()
+	select {
+	case auditQueue <- e:
+	case <-timer.C:
+		log.Printf("audit queue is full, writing %s %s to the fallback file", e.Method, e.Route)
+		writeAuditFallback([]auditEntry{e})
+	}
+}
+
+var auditFallbackMu sync.Mutex
+
+// writeAuditFallback appends entries to -audit-fallback as json lines
+func writeAuditFallback(entries []auditEntry) {
+	auditFallbackMu.Lock()
+	defer auditFallbackMu.Unlock()
+	name := *auditFallback
+	if name == "" {
+		name = pathf("audit-fallback.jsonl")
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		enc := json.NewEncoder(f)
+		for _, e := range entries {
+			if err = enc.Encode(e); err != nil {
+				break
+			}
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("audit entries are lost: %v", err)
+		auditStats.Add("dropped", int64(len(entries)))
+		return
+	}
+	auditStats.Add("fallback", int64(len(entries)))
+}
+
+type auditCtx struct{}
+
+// auditOf returns the audit entry of the request so handlers can enrich it, nil outside of auditing
+func auditOf(req *http.Request) *auditEntry {
+	e, _ := req.Context().Value(auditCtx{}).(*auditEntry)
+	return e
+}
+
+// setAuditKey records the API-Key (only its prefix) and the client a request was authorized with
+func setAuditKey(req *http.Request, k clientKey) {
+	if e := auditOf(req); e != nil {
+		e.KeyPrefix, e.Client = keyPrefix(k.Key), k.Client
+	}
+}
+
+func keyPrefix(apiKey string) string {
+	if len(apiKey) > 8 {
+		return apiKey[:8]
+	}
+	return apiKey
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// auditing is a mux middleware queueing an audit entry for every routed request
+func auditing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e := &auditEntry{At: time.Now().UTC(), Method: req.Method, ClientIP: clientIP(req)}
+		if route := mux.CurrentRoute(req); route != nil {
+			e.Route, _ = route.GetPathTemplate()
+		}
+		params := mux.Vars(req)
+		e.Card, e.Transaction = params["card"], params["transaction"]
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), auditCtx{}, e)))
+		e.Status = rec.status
+		e.LatencyMs = time.Since(e.At).Milliseconds()
+		queueAuditEntry(*e)
+	})
+}
+
+// clientIP returns the address nginx appended to X-Forwarded-For or the peer address
+func clientIP(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// flushAudit writes queued entries in batches of -audit-batch rows or every period
+func flushAudit(period time.Duration) {
+	drainAudit(auditQueue, period, insertAudit)
+}
+
+func insertAudit(entries []auditEntry) error {
+	rows := make([][]interface{}, len(entries))
+	for i, e := range entries {
+		rows[i] = []interface{}{e.At, e.KeyPrefix, e.Client, e.Method, e.Route, e.Card,
+			e.Transaction, e.Status, e.LatencyMs, e.ClientIP}
+	}
+	return persistense.BatchInsert(`INSERT INTO audit(at, key_prefix, client_id, method, route, card,
+		transaction, status, latency_ms, client_ip) VALUES`, rows)
+}
+
+// drainAudit inserts entries of queue in batches until it is closed, batches that fail go to -audit-fallback
+func drainAudit(queue <-chan auditEntry, period time.Duration, insert func([]auditEntry) error) {
+	batch := make([]auditEntry, 0, *auditBatch)
+	write := func() {
+		if len(batch) > 0 {
+			if err := insert(batch); err != nil {
+				log.Println(err)
+				writeAuditFallback(batch)
+			}
+			batch = make([]auditEntry, 0, *auditBatch)
+		}
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-queue:
+			if !ok {
+				write()
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= *auditBatch {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		}
+	}
+}
+
+// auditClient returns the client whose audit the caller may query for requested, "" - every client;
+// only operator keys see other clients
+func auditClient(p permissions, caller, requested string) (string, error) {
+	switch {
+	case p.allows(scopeOperator):
+		return requested, nil
+	case requested != "" && requested != caller:
+		return "", fmt.Errorf("api-Key has no '%s' scope to see the audit of other clients", scopeOperator)
+	}
+	return caller, nil
+}
+
+/*
+$ curl -H "API-Key: xxx" "http://localhost:8008/audit?card=XXX&from=2022-04-01T00:00:00Z&limit=10"
+[]
+*/
+func listAudit(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	k, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	client, err := auditClient(permissionsFrom(req), k.Client, q.Get("client"))
+	if err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+	where, args := []string{"true"}, []interface{}{}
+	filter := func(cond string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if client != "" {
+		filter("client_id=$%d", client)
+	}
+	for param, column := range map[string]string{"key": "key_prefix",
+		"card": "card", "transaction": "transaction", "route": "route"} {
+		if v := q.Get(param); v != "" {
+			filter(column+"=$%d", v)
+		}
+	}
+	for param, cond := range map[string]string{"from": "at>=$%d", "to": "at<$%d"} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("'%s' should be RFC3339 time: %v", param, err))
+				return
+			}
+			filter(cond, t)
+		}
+	}
+	limit := 100
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	data, err := persistense.Query(fmt.Sprintf(`SELECT (EXTRACT(EPOCH FROM at)*1000)::bigint, key_prefix, client_id,
+		method, route, card, transaction, status, latency_ms, client_ip
+		FROM audit WHERE %s ORDER BY at DESC LIMIT %d`, strings.Join(where, " AND "), limit), args...)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entries := make([]auditEntry, 0, len(data))
+	for _, row := range data {
+		ms, _ := strconv.ParseInt(row[0], 10, 64)
+		status, _ := strconv.Atoi(row[7])
+		latency, _ := strconv.ParseInt(row[8], 10, 64)
+		entries = append(entries, auditEntry{At: time.Unix(0, ms*int64(time.Millisecond)).UTC(), KeyPrefix: row[1], Client: row[2], Method: row[3],
+			Route: row[4], Card: row[5], Transaction: row[6], Status: status, LatencyMs: latency, ClientIP: row[9]})
+	}
+	render(w, req, entries)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/alive", nil)
+	req.RemoteAddr = "10.0.0.5:51234"
+	if ip := clientIP(req); ip != "10.0.0.5" {
+		t.Errorf("peer address expected without X-Forwarded-For, got %s", ip)
+	}
+	// the client may send its own X-Forwarded-For, only the entry nginx appended is trusted
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	if ip := clientIP(req); ip != "203.0.113.7" {
+		t.Errorf("last X-Forwarded-For entry expected, got %s", ip)
+	}
+}
+
+// withAuditQueue runs f with a fresh audit queue of size n and -audit-fallback in a temporary directory,
+// it returns the fallback file
+func withAuditQueue(t *testing.T, n int, f func(queue chan auditEntry)) string {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fallback := filepath.Join(dir, "audit-fallback.jsonl")
+	defer flag.Set("audit-fallback", *auditFallback)
+	flag.Set("audit-fallback", fallback)
+	defer func(q chan auditEntry) { auditQueue = q }(auditQueue)
+	auditQueue = make(chan auditEntry, n)
+	f(auditQueue)
+	return fallback
+}
+
+func readAuditFallback(t *testing.T, name string) []auditEntry {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditing(t *testing.T) {
+	withAuditQueue(t, 1, func(queue chan auditEntry) {
+		rtr := mux.NewRouter()
+		rtr.Use(auditing)
+		rtr.HandleFunc("/cards/{card}/transactions/{transaction}", func(w http.ResponseWriter, req *http.Request) {
+			auditOf(req).Client = "acme"
+			w.WriteHeader(http.StatusNotFound)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/cards/vc_1/transactions/tx_1", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		rtr.ServeHTTP(httptest.NewRecorder(), req)
+		select {
+		case e := <-queue:
+			if e.Route != "/cards/{card}/transactions/{transaction}" || e.Card != "vc_1" || e.Transaction != "tx_1" ||
+				e.Status != http.StatusNotFound || e.Method != http.MethodGet || e.Client != "acme" || e.ClientIP != "203.0.113.7" {
+				t.Errorf("unexpected audit entry %+v", e)
+			}
+		default:
+			t.Error("an audit entry should be queued for a routed request")
+		}
+	})
+}
+
+func TestAuditQueueFull(t *testing.T) {
+	defer flag.Set("audit-queue-timeout", auditQueueTimeout.String())
+	flag.Set("audit-queue-timeout", "10ms")
+	counted := func() int64 {
+		if v, ok := auditStats.Get("fallback").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := counted()
+	fallback := withAuditQueue(t, 1, func(queue chan auditEntry) {
+		queueAuditEntry(auditEntry{Route: "/first"})
+		queueAuditEntry(auditEntry{Route: "/second"})
+		if e := <-queue; e.Route != "/first" {
+			t.Errorf("first entry should be queued, got %+v", e)
+		}
+	})
+	if entries := readAuditFallback(t, fallback); len(entries) != 1 || entries[0].Route != "/second" {
+		t.Errorf("entry that found the queue full should be in the fallback file, got %+v", entries)
+	}
+	if after := counted(); after != before+1 {
+		t.Errorf("fallback entries should be counted, %d before, %d after", before, after)
+	}
+}
+
+func TestDrainAudit(t *testing.T) {
+	defer flag.Set("audit-batch", "100")
+	flag.Set("audit-batch", "2")
+	fallback := withAuditQueue(t, 8, func(queue chan auditEntry) {
+		for _, route := range []string{"/a", "/b", "/c", "/d", "/e"} {
+			queue <- auditEntry{Route: route, At: time.Now()}
+		}
+		close(queue)
+		batches := [][]string{}
+		drainAudit(queue, time.Hour, func(entries []auditEntry) error {
+			routes := []string{}
+			for _, e := range entries {
+				routes = append(routes, e.Route)
+			}
+			batches = append(batches, routes)
+			if len(batches) == 2 {
+				return errors.New("database is down")
+			}
+			return nil
+		})
+		if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 || batches[2][0] != "/e" {
+			t.Errorf("batches of -audit-batch entries and the rest on close expected, got %v", batches)
+		}
+	})
+	if entries := readAuditFallback(t, fallback); len(entries) != 2 || entries[0].Route != "/c" || entries[1].Route != "/d" {
+		t.Errorf("batch that failed to insert should be in the fallback file, got %+v", entries)
+	}
+}
+
+func TestAuditClient(t *testing.T) {
+	admin, operator := parsePermissions("admin", ""), parsePermissions("admin,operator", "")
+	if c, err := auditClient(admin, "acme", ""); err != nil || c != "acme" {
+		t.Errorf("admin should see its own client, got '%s' (%v)", c, err)
+	}
+	if _, err := auditClient(admin, "acme", "other"); err == nil {
+		t.Error("admin should not see other clients")
+	}
+	if c, err := auditClient(operator, "acme", ""); err != nil || c != "" {
+		t.Errorf("operator should see every client, got '%s' (%v)", c, err)
+	}
+	if c, err := auditClient(operator, "acme", "other"); err != nil || c != "other" {
+		t.Errorf("operator should filter by the requested client, got '%s' (%v)", c, err)
+	}
+	if parsePermissions("*", "").allows(scopeOperator) {
+		t.Error("'*' should not allow operator")
+	}
+}
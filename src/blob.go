@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var blobBackend = flag.String("blob", "file", "blob storage backend as name[:argument], e.g. file:/data/blobs")
+
+// blobStore keeps binary objects such as receipts by key
+type blobStore interface {
+	Put(key string, r io.Reader) (int64, error)
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// blobBackends are constructors of blob stores by -blob name, the argument is backend specific
+var blobBackends = map[string]func(arg string) (blobStore, error){
+	"file": func(arg string) (blobStore, error) {
+		if arg == "" {
+			arg = pathf("blobs")
+		}
+		return newFileStore(arg)
+	},
+}
+
+var blobs blobStore
+
+func initBlobs() error {
+	parts := strings.SplitN(*blobBackend, ":", 2)
+	backend, ok := blobBackends[parts[0]]
+	if !ok {
+		return fmt.Errorf("unknown blob backend '%s'", parts[0])
+	}
+	arg := ""
+	if len(parts) > 1 {
+		arg = parts[1]
+	}
+	var err error
+	blobs, err = backend(arg)
+	return err
+}
+
+// fileStore keeps blobs as files under dir
+type fileStore struct{ dir string }
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (f *fileStore) path(key string) (string, error) {
+	p := filepath.Join(f.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(f.dir)+string(filepath.Separator)) {
+		return "", errors.New("blob key escapes the storage directory")
+	}
+	return p, nil
+}
+
+func (f *fileStore) Put(key string, r io.Reader) (int64, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return 0, err
+	}
+	tmp := p + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	return n, os.Rename(tmp, p)
+}
+
+func (f *fileStore) Get(key string) (io.ReadCloser, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (f *fileStore) Delete(key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
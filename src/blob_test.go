@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	fs, err := newFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := fs.Put("receipts/vc_1/t1/r1", strings.NewReader("receipt")); err != nil || n != 7 {
+		t.Fatalf("Put: %d %v", n, err)
+	}
+	r, err := fs.Get("receipts/vc_1/t1/r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "receipt" {
+		t.Errorf("unexpected content '%s'", b)
+	}
+	if _, err := fs.Put("../escape", strings.NewReader("x")); err == nil {
+		t.Errorf("keys outside of the storage directory should be rejected")
+	}
+	if err := fs.Delete("receipts/vc_1/t1/r1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Get("receipts/vc_1/t1/r1"); err == nil {
+		t.Errorf("deleted blob is still there")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command of the service binary, selected by the first argument after the flags
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":       {"run the service (default)", serve},
+	"migrate":     {"create missing tables and columns", migrateCommand},
+	"client":      {"add|list|revoke API-Keys", subcommand("client", clientCommands)},
+	"account":     {"link|list|unlink Extend accounts of a client", subcommand("account", accountCommands)},
+	"config":      {"print the effective configuration", subcommand("config", configCommands)},
+	"token":       {"flush cached Extend sessions", subcommand("token", tokenCommands)},
+	"sync":        {"run the transaction sync", subcommand("sync", syncCommands)},
+	"purge":       {"[-dry-run] delete rows older than -retention", purgeCommand},
+	"healthcheck": {"probe /alive of the running service, exit status 1 if it is not healthy", healthcheck},
+}
+
+var (
+	clientCommands = map[string]command{
+		"add":    {"-email e -password p [-client id] [-scopes s] [-cards c] [-expires d] [-jwt-subject sub]", clientAdd},
+		"list":   {"[-client id] [-all]", clientList},
+		"revoke": {"api-key...", clientRevoke},
+	}
+	tokenCommands = map[string]command{
+		"flush": {"[api-key...], every key by default", tokenFlush},
+	}
+	syncCommands = map[string]command{
+		"run": {"[-key api-key] [-card id]", syncRun},
+	}
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+		for _, name := range commandNames(commands) {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-12s %s\n", name, commands[name].usage)
+		}
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+}
+
+func commandNames(m map[string]command) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCommand runs the command named by the first of args, serve without args
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		return serve(nil)
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		flag.Usage()
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+	return c.run(args[1:])
+}
+
+// subcommand dispatches the first argument to one of subs
+func subcommand(name string, subs map[string]command) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 0 {
+			if c, ok := subs[args[0]]; ok {
+				return c.run(args[1:])
+			}
+		}
+		usage := make([]string, 0, len(subs))
+		for _, sub := range commandNames(subs) {
+			usage = append(usage, fmt.Sprintf("  %s %s %s", name, sub, subs[sub].usage))
+		}
+		return fmt.Errorf("expected one of:\n%s", strings.Join(usage, "\n"))
+	}
+}
+
+func migrateCommand(args []string) error {
+	persistense.Initialize()
+	if persistense.DB() == nil {
+		return errors.New("no DB connection")
+	}
+	migrate()
+	fmt.Println("migrated")
+	return nil
+}
+
+func clientAdd(args []string) error {
+	fs := flag.NewFlagSet("client add", flag.ContinueOnError)
+	email := fs.String("email", "", "Extend user email")
+	password := fs.String("password", os.Getenv("EXTEND_PASSWORD"), "Extend user password, EXTEND_PASSWORD by default")
+	client := fs.String("client", "", "client id the key belongs to, the key itself by default")
+	scopes := fs.String("scopes", scopeAll, "comma separated scopes")
+	cards := fs.String("cards", "", "comma separated cards the key is limited to, every card by default")
+	expires := fs.Duration("expires", 0, "key lifetime, 0 - never expires")
+	subject := fs.String("jwt-subject", "", "bearer token subject mapped to the key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" || *password == "" {
+		return errors.New("-email and -password are required")
+	}
+	known := []string{scopeAll, scopeAdmin, scopeCardsRead, scopeCardsWrite, scopeTransactionsRead, scopeTransactionsWrite,
+		scopeAccountsRead, scopeAccountsWrite, scopeOperator}
+	for _, s := range splitList(*scopes) {
+		if !contains(known, s) {
+			return fmt.Errorf("unknown scope '%s', known are %s", s, strings.Join(known, ", "))
+		}
+	}
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	var expiresAt interface{}
+	if *expires > 0 {
+		expiresAt = time.Now().Add(*expires)
+	}
+	persistense.Initialize()
+	if err := persistense.Exec(`INSERT INTO clients(api_key, client_id, email, password, scopes, cards, issued_at,
+		expires_at, jwt_subject) VALUES ($1, $2, $3, $4, $5, $6, now(), $7, $8)`,
+		key, *client, *email, *password, strings.Join(splitList(*scopes), ","), strings.Join(splitList(*cards), ","),
+		expiresAt, *subject); err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func clientList(args []string) error {
+	fs := flag.NewFlagSet("client list", flag.ContinueOnError)
+	client := fs.String("client", "", "only keys of the client")
+	all := fs.Bool("all", false, "include revoked and expired keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	where, params := []string{"true"}, []interface{}{}
+	if *client != "" {
+		params = append(params, *client)
+		where = append(where, clientIdColumn+"=$1")
+	}
+	if !*all {
+		where = append(where, "revoked_at IS NULL AND (expires_at IS NULL OR expires_at>now())")
+	}
+	persistense.Initialize()
+	data, err := persistense.Query(`SELECT `+apiKeyColumns+`, email, COALESCE(EXTRACT(EPOCH FROM last_used_at)::bigint, 0)
+		FROM clients WHERE `+strings.Join(where, " AND ")+` ORDER BY `+clientIdColumn+`, issued_at`, params...)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tCLIENT\tEMAIL\tSCOPES\tCARDS\tISSUED\tEXPIRES\tREVOKED\tLAST USED")
+	for _, row := range data {
+		k := clientKeyFromRow(row)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", keyPrefix(k.Key), k.Client, row[8],
+			strings.Join(k.Scopes, ","), strings.Join(k.Cards, ","), timeOrDash(k.Issued), timeOrDash(k.Expires),
+			timeOrDash(k.Revoked), timeOrDash(unixOrZero(row[9])))
+	}
+	return tw.Flush()
+}
+
+func timeOrDash(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// clientRevoke revokes keys in the database, running services reject them once their cached row expires after
+// apiKeyTTL; DELETE /keys/{key} revokes at once
+func clientRevoke(args []string) error {
+	if len(args) == 0 {
+		return errors.New("api-Keys to revoke are expected")
+	}
+	persistense.Initialize()
+	for _, key := range args {
+		data, err := persistense.Query(`UPDATE clients SET revoked_at=now() WHERE api_key=$1 AND revoked_at IS NULL
+			RETURNING api_key`, key)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("api-Key '%s' is not found or already revoked", keyPrefix(key))
+		}
+		fmt.Printf("%s revoked, running services reject it within %s\n", keyPrefix(key), apiKeyTTL)
+	}
+	return nil
+}
+
+// tokenFlush makes running services sign in to Extend again, they notice it within apiKeyTTL
+func tokenFlush(args []string) error {
+	persistense.Initialize()
+	var data [][]string
+	var err error
+	if len(args) == 0 {
+		data, err = persistense.Query(`UPDATE clients SET tokens_flushed_at=now() RETURNING api_key`)
+	} else {
+		for _, key := range args {
+			var rows [][]string
+			if rows, err = persistense.Query(`UPDATE clients SET tokens_flushed_at=now() WHERE api_key=$1
+				RETURNING api_key`, key); err != nil {
+				break
+			}
+			data = append(data, rows...)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Extend sessions of %d api-Keys flushed\n", len(data))
+	return nil
+}
+
+// syncRun syncs the ledger of every card of every Extend user once
+func syncRun(args []string) error {
+	fs := flag.NewFlagSet("sync run", flag.ContinueOnError)
+	key := fs.String("key", "", "sign in with this api-Key only, the newest key of every Extend user by default")
+	only := fs.String("card", "", "sync only this card")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	persistense.Initialize()
+	keys := []string{*key}
+	if *key == "" {
+		var err error
+		if keys, err = userKeys(); err != nil {
+			return err
+		}
+	}
+	failed := 0
+	accounts := keyAccounts(keys)
+	for _, ka := range accounts {
+		k, err := lookupKey(ka.Key)
+		if err == nil {
+			var tok token
+			if tok, err = accountSession(ka.Key, ka.Account); err == nil {
+				err = syncUser(tok.Token, k.Client, *only)
+			}
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s/%s: %v\n", keyPrefix(ka.Key), ka.Account, err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("sync failed for %d of %d accounts", failed, len(accounts))
+	}
+	return nil
+}
+
+func syncUser(tok, client, only string) error {
+	cards, err := fetchCards(tok)
+	if err != nil {
+		return err
+	}
+	for _, c := range cards {
+		if only != "" && c.Id != only {
+			continue
+		}
+		events, err := syncCard(tok, c.Id, client)
+		if err != nil {
+			return fmt.Errorf("card '%s': %v", c.Id, err)
+		}
+		fmt.Printf("card %s: %d new or changed transactions\n", c.Id, len(events))
+	}
+	return nil
+}
+
+// healthcheck exits with an error unless /alive of the service on -p answers in time
+func healthcheck(args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for the answer")
+	url := fs.String("url", fmt.Sprintf("http://127.0.0.1:%d/alive", *port), "probed url")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: *timeout}).Get(*url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d: %s", *url, resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubcommand(t *testing.T) {
+	ran := ""
+	run := subcommand("client", map[string]command{
+		"add": {"", func(args []string) error { ran = "add " + strings.Join(args, " "); return nil }},
+	})
+	if err := run([]string{"add", "-email", "e"}); err != nil || ran != "add -email e" {
+		t.Errorf("add should run with its arguments, ran '%s', %v", ran, err)
+	}
+	if err := run([]string{"remove"}); err == nil || !strings.Contains(err.Error(), "client add") {
+		t.Errorf("unknown subcommand should list known ones, got %v", err)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	if err := healthcheck([]string{"-url", srv.URL + "/alive"}); err != nil {
+		t.Errorf("service should be healthy: %v", err)
+	}
+	if err := healthcheck([]string{"-url", srv.URL + "/missing"}); err == nil {
+		t.Error("404 should not be healthy")
+	}
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	down.Close()
+	if err := healthcheck([]string{"-url", down.URL + "/alive", "-timeout", "100ms"}); err == nil {
+		t.Error("closed server should not be healthy")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// every setting is a flag of the command line; a configuration file, then the environment, then flags given on
+// the command line override their defaults
+
+var configFile = flag.String("config", "", "YAML (.yaml, .yml) or TOML (.toml) configuration file")
+
+// secretSettings are never printed
+var secretSettings = map[string]bool{"dbpsw": true, "jwt-secret": true}
+
+// envNames of settings not named EXTEND_<NAME>, <NAME> is the flag name without extend- prefix upper case
+// with '-' replaced by '_'
+var envNames = map[string]string{
+	"config":     "CONFIG",
+	"dbu":        "DBUSER",
+	"dbpsw":      "DBPASS",
+	"dbn":        "DBNAME",
+	"dbh":        "DBHOST",
+	"dbport":     "DBPORT",
+	"jwt-secret": "JWT_SECRET",
+}
+
+func envName(setting string) string {
+	if name, ok := envNames[setting]; ok {
+		return name
+	}
+	return "EXTEND_" + strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(setting, "extend-"), "-", "_"))
+}
+
+// lookupEnv returns the environment value of a setting, <NAME>_FILE names a file with the value (Docker secrets)
+func lookupEnv(setting string) (string, bool, error) {
+	name := envName(setting)
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true, nil
+	}
+	file, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// configSources tells where every changed setting came from: file, env or flag
+var configSources = map[string]string{}
+
+// loadConfig layers the configuration file and the environment under flags given on the command line
+// and validates the result; flag.Parse must be called before
+func loadConfig() error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name], configSources[f.Name] = true, "flag"
+	})
+	set := func(name, value, source string) error {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s from %s: %v", name, source, err)
+		}
+		configSources[name] = source
+		return nil
+	}
+	if !explicit["config"] {
+		if v, ok, err := lookupEnv("config"); err != nil {
+			return err
+		} else if ok {
+			if err := set("config", v, "env"); err != nil {
+				return err
+			}
+		}
+	}
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if flag.Lookup(name) == nil || name == "config" {
+				return fmt.Errorf("unknown setting '%s' in %s", name, *configFile)
+			}
+			if !explicit[name] {
+				if err := set(name, values[name], "file"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		var v string
+		var ok bool
+		if v, ok, err = lookupEnv(f.Name); err == nil && ok {
+			err = set(f.Name, v, "env")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return validateConfig()
+}
+
+// readConfigFile returns settings of a YAML or TOML file by flag name; nested tables are joined with '-',
+// so jwt: {iss: x} sets -jwt-iss, and lists are joined with ','
+func readConfigFile(file string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		err = toml.Unmarshal(b, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &raw)
+	default:
+		return nil, fmt.Errorf("configuration file '%s' should be .yaml, .yml or .toml", file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	values := map[string]string{}
+	flatten("", raw, values)
+	return values, nil
+}
+
+func flatten(prefix string, v interface{}, values map[string]string) {
+	join := func(k interface{}) string {
+		if prefix == "" {
+			return fmt.Sprint(k)
+		}
+		return prefix + "-" + fmt.Sprint(k)
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			flatten(join(k), e, values)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range t {
+			flatten(join(k), e, values)
+		}
+	case []interface{}:
+		parts := make([]string, len(t))
+		for i, e := range t {
+			parts[i] = fmt.Sprint(e)
+		}
+		values[prefix] = strings.Join(parts, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = fmt.Sprint(t)
+	}
+}
+
+// validateConfig reports every invalid setting at once
+func validateConfig() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	intSetting := func(name string) int {
+		v, _ := strconv.Atoi(flag.Lookup(name).Value.String())
+		return v
+	}
+	check(*port > 0 && *port < 65536, "-p should be between 1 and 65535 but it is %d", *port)
+	check(*grpcPort >= 0 && *grpcPort < 65536, "-grpc-port should be between 0 and 65535 but it is %d", *grpcPort)
+	check(intSetting("dbport") > 0 && intSetting("dbport") < 65536, "-dbport should be between 1 and 65535")
+	if u, err := url.Parse(*extendBase); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("-extend-url '%s' should be an absolute http(s) url", *extendBase))
+	}
+	check(*extendVersion != "", "-extend-version should not be empty")
+	check(*extendTimeout > 0, "-extend-timeout should be positive")
+	check(*clockSkew >= 0, "-clock-skew should not be negative")
+	check(*watchInterval > 0, "-watch-interval should be positive")
+	check(*reconcilePeriod > 0, "-reconcile-period should be positive")
+	check(*reconcileInterval >= 0, "-reconcile-interval should not be negative")
+	check(*rotationGrace >= 0, "-rotation-grace should not be negative")
+	check(*auditBatch > 0, "-audit-batch should be positive")
+	check(*receiptMax > 0, "-receipt-max should be positive")
+	if _, err := enabledChecks(*anomalyChecks); err != nil {
+		problems = append(problems, fmt.Sprintf("-anomaly-checks: %v", err))
+	}
+	check(*anomalySigma > 0, "-anomaly-amount-sigma should be positive")
+	check(*anomalyHistory >= 2, "-anomaly-min-history should be at least 2")
+	check(*anomalyDecline > 0, "-anomaly-declines should be positive")
+	check(*declineWindow > 0, "-anomaly-decline-window should be positive")
+	if _, err := parseTTLs(*cacheTTLs); err != nil {
+		problems = append(problems, fmt.Sprintf("-cache-ttl: %v", err))
+	}
+	check(*cacheEntries > 0, "-cache-entries should be positive")
+	if _, ok := blobBackends[strings.SplitN(*blobBackend, ":", 2)[0]]; !ok {
+		problems = append(problems, fmt.Sprintf("-blob: unknown backend '%s'", *blobBackend))
+	}
+	if _, ok := statementPeriods[*statementPeriod]; !ok {
+		problems = append(problems, fmt.Sprintf("-statement-period should be weekly, monthly or quarterly but it is '%s'", *statementPeriod))
+	}
+	if _, err := parseRetention(*retention); err != nil {
+		problems = append(problems, fmt.Sprintf("-retention: %v", err))
+	}
+	check(*purgeInterval >= 0, "-purge-interval should not be negative")
+	check(*auditQueueTimeout >= 0, "-audit-queue-timeout should not be negative")
+	check(*purgeBatchSize > 0, "-purge-batch should be positive")
+	check(*statementInterval >= 0, "-statement-interval should not be negative")
+	check(*syncInterval >= 0, "-sync-interval should not be negative")
+	if _, ok := mailBackends[strings.SplitN(*mailBackend, ":", 2)[0]]; !ok {
+		problems = append(problems, fmt.Sprintf("-mail: unknown backend '%s'", *mailBackend))
+	}
+	if mode := strings.SplitN(*extendFixtures, ":", 2)[0]; *extendFixtures != "" && fixtureModes[mode] == nil {
+		problems = append(problems, fmt.Sprintf("-extend-fixtures: unknown mode '%s', should be record or replay", mode))
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+var configCommands = map[string]command{
+	"print": {"effective settings as YAML, secrets redacted", configPrint},
+}
+
+// configPrint writes every setting in the configuration file format with its source as a comment
+func configPrint(args []string) error {
+	names := []string{}
+	flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" {
+			continue
+		}
+		v := flag.Lookup(name).Value.String()
+		if secretSettings[name] && v != "" {
+			v = "********"
+		}
+		source := configSources[name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Printf("%s: %s # %s, %s\n", name, strconv.Quote(v), source, envName(name))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadConfigFile(t *testing.T) {
+	for name, content := range map[string]string{
+		"c.yaml": "p: 8001\njwt:\n  iss: https://idp\ncache-ttl: [cards=1m, transactions=30s]\n",
+		"c.toml": "p = 8001\ncache-ttl = [\"cards=1m\", \"transactions=30s\"]\n[jwt]\niss = \"https://idp\"\n",
+	} {
+		values, err := readConfigFile(writeTemp(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if values["p"] != "8001" || values["jwt-iss"] != "https://idp" || values["cache-ttl"] != "cards=1m,transactions=30s" {
+			t.Errorf("%s: unexpected settings %v", name, values)
+		}
+	}
+	if _, err := readConfigFile(writeTemp(t, "c.ini", "p=1")); err == nil {
+		t.Error(".ini should not be accepted")
+	}
+}
+
+func TestLookupEnv(t *testing.T) {
+	if envName("dbpsw") != "DBPASS" || envName("grpc-port") != "EXTEND_GRPC_PORT" || envName("extend-url") != "EXTEND_URL" {
+		t.Errorf("unexpected env names %s %s %s", envName("dbpsw"), envName("grpc-port"), envName("extend-url"))
+	}
+	os.Setenv("JWT_SECRET_FILE", writeTemp(t, "secret", "s3cret\n"))
+	defer os.Unsetenv("JWT_SECRET_FILE")
+	if v, ok, err := lookupEnv("jwt-secret"); err != nil || !ok || v != "s3cret" {
+		t.Errorf("secret should be read from JWT_SECRET_FILE, got '%s' %v %v", v, ok, err)
+	}
+	os.Setenv("JWT_SECRET", "direct")
+	defer os.Unsetenv("JWT_SECRET")
+	if v, _, _ := lookupEnv("jwt-secret"); v != "direct" {
+		t.Errorf("JWT_SECRET should win over JWT_SECRET_FILE, got '%s'", v)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	grpc, watch, timeout := *grpcPort, *watchInterval, *extendTimeout
+	defer func() {
+		*grpcPort, *watchInterval, *extendTimeout, *configFile = grpc, watch, timeout, ""
+	}()
+	os.Setenv("CONFIG", writeTemp(t, "c.yaml", "grpc-port: 9100\nwatch-interval: 1s\nextend-timeout: 20s\n"))
+	defer os.Unsetenv("CONFIG")
+	os.Setenv("EXTEND_WATCH_INTERVAL", "5s")
+	defer os.Unsetenv("EXTEND_WATCH_INTERVAL")
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if *grpcPort != 9100 || *watchInterval != 5*time.Second || *extendTimeout != 20*time.Second {
+		t.Errorf("env should override the file: grpc %d, watch %v, timeout %v", *grpcPort, *watchInterval, *extendTimeout)
+	}
+	if configSources["watch-interval"] != "env" || configSources["grpc-port"] != "file" {
+		t.Errorf("unexpected sources %v", configSources)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := validateConfig(); err != nil {
+		t.Fatalf("defaults should be valid: %v", err)
+	}
+	defer flag.Set("extend-url", *extendBase)
+	defer flag.Set("audit-batch", flag.Lookup("audit-batch").Value.String())
+	flag.Set("extend-url", "api.paywithextend.com")
+	flag.Set("audit-batch", "0")
+	if err := validateConfig(); err == nil {
+		t.Error("relative extend-url and zero audit-batch should be invalid")
+	}
+}
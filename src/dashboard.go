@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var staticMaxAge = flag.Duration("static-max-age", time.Hour, "how long browsers cache dashboard assets, index.html is always revalidated")
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardFS looks a file up in staticDir first, so a deployment can replace any file of the embedded dashboard
+type dashboardFS struct {
+	dir      string
+	embedded fs.FS
+}
+
+func (d dashboardFS) read(name string) ([]byte, time.Time, error) {
+	if d.dir != "" {
+		p := path.Join(d.dir, name)
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			content, err := ioutil.ReadFile(p)
+			return content, st.ModTime(), err
+		}
+	}
+	content, err := fs.ReadFile(d.embedded, name)
+	return content, time.Time{}, err
+}
+
+func newDashboardFS(dir string) dashboardFS {
+	embedded, _ := fs.Sub(dashboardFiles, "dashboard")
+	return dashboardFS{dir: dir, embedded: embedded}
+}
+
+/*
+$ curl -i http://localhost:8008/static/
+HTTP/1.1 200 OK
+Cache-Control: no-cache
+Content-Type: text/html; charset=utf-8
+Etag: "2f1c..."
+*/
+func dashboard(files dashboardFS) http.Handler {
+	return http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+		if name == "" {
+			name = "index.html"
+		}
+		content, modified, err := files.read(name)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			http.NotFound(w, req)
+			return
+		} else if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		sum := sha256.Sum256(content)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		if name == "index.html" || *staticMaxAge <= 0 {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(staticMaxAge.Seconds())))
+		}
+		http.ServeContent(w, req, name, modified, bytes.NewReader(content))
+	}))
+}
@@ -0,0 +1,126 @@
+// Dashboard of the service: cards, their transactions and transaction details.
+// The API-Key is kept in sessionStorage and sent as the API-Key header, pages are hash routes:
+// #/ cards, #/cards/{card} transactions, #/cards/{card}/{transaction} details.
+(function () {
+  "use strict";
+
+  var storageKey = "extend-api-key";
+  var view = document.getElementById("view");
+  var crumbs = document.getElementById("crumbs");
+  var status = document.getElementById("status");
+
+  function apiKey() { return sessionStorage.getItem(storageKey) || ""; }
+
+  function setStatus(text, error) {
+    status.textContent = text || "";
+    status.className = error ? "error" : "";
+  }
+
+  function get(path) {
+    return fetch(path, { headers: { "API-Key": apiKey(), "Accept": "application/json" } }).then(function (r) {
+      if (r.status === 401 || r.status === 403) { throw new Error("the API-Key is not valid for " + path); }
+      if (!r.ok) { throw new Error(path + ": " + r.status + " " + r.statusText); }
+      var warning = r.headers.get("Warning");
+      return r.json().then(function (body) { return { body: body, warning: warning }; });
+    });
+  }
+
+  function el(tag, attrs, children) {
+    var e = document.createElement(tag);
+    Object.keys(attrs || {}).forEach(function (k) { e.setAttribute(k, attrs[k]); });
+    (children || []).forEach(function (c) {
+      e.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+    });
+    return e;
+  }
+
+  function link(href, text) { return el("a", { href: href }, [text]); }
+
+  function money(v) { return (v || 0).toFixed(2); }
+
+  function table(headers, rows) {
+    var head = el("tr", {}, headers.map(function (h) { return el("th", {}, [h]); }));
+    return el("table", {}, [el("thead", {}, [head]), el("tbody", {}, rows)]);
+  }
+
+  function show(trail, content) {
+    crumbs.innerHTML = "";
+    trail.forEach(function (c, i) {
+      crumbs.appendChild(i < trail.length - 1 ? link(c[0], c[1]) : document.createTextNode(c[1]));
+      if (i < trail.length - 1) { crumbs.appendChild(document.createTextNode(" / ")); }
+    });
+    view.innerHTML = "";
+    view.appendChild(content);
+  }
+
+  function cards() {
+    return get("/cards").then(function (r) {
+      var rows = r.body.map(function (c) {
+        return el("tr", {}, [
+          el("td", {}, [link("#/cards/" + encodeURIComponent(c.Id), c.Name || c.Id)]),
+          el("td", {}, ["•••• " + c.Last4]),
+          el("td", {}, [c.Status]),
+          el("td", {}, [c.Account || ""]),
+          el("td", { "class": "amount" }, [money(c.Balance)])
+        ]);
+      });
+      show([["#/", "Cards"]], table(["Card", "Number", "Status", "Account", "Balance"], rows));
+      return r.warning;
+    });
+  }
+
+  function transactions(card) {
+    var base = "#/cards/" + encodeURIComponent(card);
+    return get("/cards/" + encodeURIComponent(card) + "/transactions").then(function (r) {
+      var rows = r.body.map(function (t) {
+        var a = t.Annotation || {};
+        return el("tr", t.Alert ? { "class": "alert", title: "anomaly score " + t.Alert.Score } : {}, [
+          el("td", {}, [link(base + "/" + encodeURIComponent(t.Id), t.Name)]),
+          el("td", {}, [t.Status]),
+          el("td", {}, [t.Updated]),
+          el("td", {}, [a.Category || ""]),
+          el("td", {}, [(a.Tags || []).join(", ")]),
+          el("td", { "class": "amount" }, [money(t.Amount)])
+        ]);
+      });
+      show([["#/", "Cards"], [base, card]], table(["Merchant", "Status", "Updated", "Category", "Tags", "Amount"], rows));
+      return r.warning;
+    });
+  }
+
+  function details(card, transaction) {
+    var base = "#/cards/" + encodeURIComponent(card);
+    return get("/cards/" + encodeURIComponent(card) + "/transactions/" + encodeURIComponent(transaction)).then(function (r) {
+      show([["#/", "Cards"], [base, card], ["", transaction]], el("pre", {}, [JSON.stringify(r.body, null, 2)]));
+      return r.warning;
+    });
+  }
+
+  function route() {
+    if (!apiKey()) {
+      show([["#/", "Cards"]], el("p", {}, ["Paste an API-Key above to browse its cards."]));
+      setStatus("");
+      return;
+    }
+    var parts = location.hash.replace(/^#\/?/, "").split("/").filter(Boolean).map(decodeURIComponent);
+    var page = parts[0] === "cards" && parts.length === 3 ? details(parts[1], parts[2]) :
+      parts[0] === "cards" && parts.length === 2 ? transactions(parts[1]) : cards();
+    setStatus("Loading…");
+    page.then(function (warning) { setStatus(warning || ""); }, function (err) { setStatus(err.message, true); });
+  }
+
+  document.getElementById("key").addEventListener("submit", function (e) {
+    e.preventDefault();
+    var input = document.getElementById("api-key");
+    sessionStorage.setItem(storageKey, input.value.trim());
+    input.value = "";
+    route();
+  });
+  document.getElementById("forget").addEventListener("click", function () {
+    sessionStorage.removeItem(storageKey);
+    location.hash = "#/";
+    route();
+  });
+  window.addEventListener("hashchange", route);
+  route();
+})();
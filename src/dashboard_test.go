@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.css"), []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := dashboard(newDashboardFS(dir))
+	get := func(p, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	index := get("/static/", "")
+	if index.Code != http.StatusOK || !strings.Contains(index.Body.String(), "app.js") ||
+		index.Header().Get("Cache-Control") != "no-cache" || !strings.HasPrefix(index.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("embedded index.html expected, got %d %v", index.Code, index.Header())
+	}
+	if r := get("/static/index.html", index.Header().Get("ETag")); r.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for the current ETag, got %d", r.Code)
+	}
+	if r := get("/static/app.js", ""); r.Code != http.StatusOK || r.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("embedded app.js should be cached, got %d %v", r.Code, r.Header())
+	}
+	if r := get("/static/app.css", ""); r.Body.String() != "body {}" {
+		t.Errorf("app.css of the static directory should take precedence, got %s", r.Body)
+	}
+	for _, p := range []string{"/static/missing.js", "/static/../dashboard.go"} {
+		if r := get(p, ""); r.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", p, r.Code)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 // https://gethttpsforfree.com/
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -17,48 +18,106 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	port               = flag.Int("p", 8000, "port to listen on")
 	root               = flag.String("r", "~", "base path")
+	extendBase         = flag.String("extend-url", "https://api.paywithextend.com", "Extend API base url")
+	extendVersion      = flag.String("extend-version", "2021-03-12", "Extend API version requested in Accept header")
+	extendTimeout      = flag.Duration("extend-timeout", 10*time.Second, "timeout of Extend API requests")
 	baseDir, staticDir string
 	pathf              func(p string) string
 )
 
 func main() {
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
 	baseDir = filepath.Clean(*root)
 	staticDir = path.Clean(path.Join(baseDir, "static"))
 	pathf = func(p string) string { return filepath.Join(baseDir, p) }
-	if *port < 1 || *port > 65535 {
-		log.Fatalf("Port should be between 0 and 65536 but it is %d", port)
+	if err := runCommand(flag.Args()); err != nil {
+		log.Fatal(err)
 	}
+}
+
+// serve is the default command, it runs the service
+func serve(args []string) error {
 	persistense.Initialize()
-	go func() {
-		err := persistense.CreateTable("clients", []string{
-			`create table clients(api_key varchar(64), email varchar(256), password varchar(256), PRIMARY KEY(api_key));`,
-		})
-		sqlerr(err)
-	}()
-	rtr := mux.NewRouter()
-	rtr.HandleFunc("/alive", alive).Methods("GET")
-	rtr.HandleFunc("/version", version).Methods("GET")
-	rtr.HandleFunc("/cards", listCards).Methods("GET")
-	rtr.HandleFunc("/cards/", listCards).Methods("GET")
-	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions", listTransactions).Methods("GET")
-	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/", listTransactions).Methods("GET")
-	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/{transaction:[0-9aA-z\\-_]+}", details).Methods("GET")
+	initJWT()
+	initResponseCache()
+	if err := initBlobs(); err != nil {
+		return fmt.Errorf("Error initializing blob storage: %v", err)
+	}
+	go migrate()
+	go flushLastUsed(30 * time.Second)
+	go flushAudit(2 * time.Second)
+	go serveGRPC()
+	go runReconciliation(*reconcileInterval)
+	go runStatements(*statementInterval)
+	go runPurge(*purgeInterval)
+	go runSync(*syncInterval)
+	rtr := newRouter()
 	// mux.HandleFunc("/cards/")
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", *port),
 		Handler: proxy{Handler: rtr},
 	}
-	err := srv.ListenAndServe()
-	if err != nil {
-		log.Fatal("ListenAndServeTLS: ", err)
+	if err := srv.ListenAndServe(); err != nil {
+		return fmt.Errorf("ListenAndServeTLS: %v", err)
 	}
+	return nil
+}
+
+// newRouter registers every route of the service, keep openapi.go in sync
+func newRouter() *mux.Router {
+	rtr := mux.NewRouter()
+	rtr.Use(auditing)
+	rtr.Handle("/", http.RedirectHandler("/static/", http.StatusFound)).Methods("GET")
+	rtr.PathPrefix("/static/").Handler(dashboard(newDashboardFS(staticDir))).Methods("GET")
+	rtr.HandleFunc("/alive", alive).Methods("GET")
+	rtr.HandleFunc("/version", version).Methods("GET")
+	rtr.HandleFunc("/openapi.json", openapi).Methods("GET")
+	rtr.HandleFunc("/metrics", authorize(scopeAdmin, metrics)).Methods("GET")
+	rtr.HandleFunc("/me", authorize("", me)).Methods("GET")
+	rtr.HandleFunc("/graphql", authorize("", graphqlHandler)).Methods("GET", "POST")
+	rtr.HandleFunc("/accounts", authorize(scopeAccountsRead, listAccounts)).Methods("GET")
+	rtr.HandleFunc("/accounts", authorize(scopeAccountsWrite, linkAccount)).Methods("POST")
+	rtr.HandleFunc("/accounts/{account:[0-9a-f]+}", authorize(scopeAccountsWrite, unlinkAccount)).Methods("DELETE")
+	rtr.HandleFunc("/audit", authorize(scopeAdmin, listAudit)).Methods("GET")
+	rtr.HandleFunc("/retention", authorize(scopeAdmin, retentionReport)).Methods("GET")
+	rtr.HandleFunc("/retention/purge", authorize(scopeAdmin, purgeNow)).Methods("POST")
+	rtr.HandleFunc("/rules", authorize(scopeAdmin, listRules)).Methods("GET")
+	rtr.HandleFunc("/rules", authorize(scopeAdmin, createRule)).Methods("POST")
+	rtr.HandleFunc("/rules/{rule:[0-9]+}", authorize(scopeAdmin, updateRule)).Methods("PUT")
+	rtr.HandleFunc("/rules/{rule:[0-9]+}", authorize(scopeAdmin, deleteRule)).Methods("DELETE")
+	rtr.HandleFunc("/reconciliation", authorize(scopeTransactionsRead, listReconciliations)).Methods("GET")
+	rtr.HandleFunc("/reconciliation", authorize(scopeTransactionsRead, runReconciliationNow)).Methods("POST")
+	rtr.HandleFunc("/reconciliation/{run:[0-9]+}", authorize(scopeTransactionsRead, getReconciliation)).Methods("GET")
+	rtr.HandleFunc("/alerts", authorize(scopeTransactionsRead, listAlerts)).Methods("GET")
+	rtr.HandleFunc("/alerts/{alert:[0-9]+}/acknowledge", authorize(scopeTransactionsWrite, acknowledgeAlert)).Methods("POST")
+	rtr.HandleFunc("/subscriptions", authorize(scopeTransactionsRead, listSubscriptions)).Methods("GET")
+	rtr.HandleFunc("/keys/rotate", authorize("", rotateKey)).Methods("POST")
+	rtr.HandleFunc("/keys/{key:[0-9a-zA-Z\\-_]+}", authorize("", revokeKey)).Methods("DELETE")
+	rtr.HandleFunc("/cards", authorize(scopeCardsRead, cached(listCards))).Methods("GET")
+	rtr.HandleFunc("/cards/", authorize(scopeCardsRead, cached(listCards))).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions", authorize(scopeTransactionsRead, cached(listTransactions))).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/", authorize(scopeTransactionsRead, cached(listTransactions))).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/categorize", authorize(scopeTransactionsRead, categorizeCard)).Methods("POST")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/statements", authorize(scopeTransactionsRead, ownedCard(listStatements))).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/statements", authorize(scopeTransactionsWrite, ownedCard(createStatement))).Methods("POST")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/statements/{statement:[0-9]+}", authorize(scopeTransactionsRead, ownedCard(downloadStatement))).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/stream", authorize(scopeTransactionsRead, streamTransactions)).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/{transaction:[0-9aA-z\\-_]+}/annotations", authorize(scopeTransactionsWrite, putAnnotation)).Methods("PUT")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/{transaction:[0-9aA-z\\-_]+}/receipts", authorize(scopeTransactionsWrite, uploadReceipt)).Methods("POST")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/{transaction:[0-9aA-z\\-_]+}/receipts", authorize(scopeTransactionsRead, ownedCard(listReceipts))).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/{transaction:[0-9aA-z\\-_]+}/receipts/{receipt:[0-9a-f]+}", authorize(scopeTransactionsRead, ownedCard(downloadReceipt))).Methods("GET")
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions/{transaction:[0-9aA-z\\-_]+}", authorize(scopeTransactionsRead, cached(details))).Methods("GET")
+	return rtr
 }
 
 type proxy struct{ Handler http.Handler }
@@ -73,6 +132,7 @@ $ curl http://localhost:8008/alive
 {"alive": true}
 */
 func alive(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"alive": true}`))
 }
 
@@ -86,9 +146,18 @@ func version(w http.ResponseWriter, req *http.Request) {
 		log.Println(err)
 		content = []byte(fmt.Sprintf("error reading file with version information: %v", err))
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(fmt.Sprintf(`{"version": "%s"}`, strings.TrimSpace(string(content)))))
 }
 
+// httpError writes status with a json body describing err
+func httpError(w http.ResponseWriter, status int, err error) {
+	retval, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(retval)
+}
+
 func sqlerr(err error) {
 	if err != nil {
 		log.Printf("SQL Error '%v'", err)
@@ -101,6 +170,7 @@ type card struct {
 	Balance float64
 	Name    string
 	Status  string
+	Account string `json:",omitempty"` // id of the Extend account of the card, see /accounts
 }
 
 /*
@@ -108,77 +178,188 @@ $ curl -H "API-Key: xxx" http://localhost:8008/cards
 []
 */
 func listCards(w http.ResponseWriter, req *http.Request) {
-	if tok, err := signin(req); err != nil {
+	if cards, failed, err := fetchAllCards(requestKey(req)); err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusUnauthorized)
 	} else {
-		reqOut, _ := http.NewRequest(http.MethodGet, "https://api.paywithextend.com/virtualcards?count=50", nil)
-		reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
-		if cards, err := extendAPI(reqOut); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusUnauthorized)
-		} else {
-			// retval, _ := json.MarshalIndent(cards, "  ", "  ") // pass through
-			cardsOutput := make([]card, 0)
-			for _, c := range cards.ArrayOrEmpty("virtualCards") {
-				g := gjson.FromGeneric(c)
-				cardsOutput = append(cardsOutput,
-					card{
-						Id:      g.StringOrEmpty("id"),
-						Last4:   g.StringOrEmpty("last4"),
-						Balance: g.FloatOrZero("balanceCents") * 0.01,
-						Name:    g.StringOrEmpty("displayName"),
-						Status:  g.StringOrEmpty("status"),
-					})
+		if len(failed) > 0 {
+			w.Header().Set("Warning", fmt.Sprintf(`199 - "accounts %s are unavailable"`, strings.Join(failed, ", ")))
+		}
+		perms := permissionsFrom(req)
+		cardsOutput := make([]card, 0)
+		for _, c := range cards {
+			if perms.allowsCard(c.Id) {
+				cardsOutput = append(cardsOutput, c)
 			}
-			retval, _ := json.MarshalIndent(cardsOutput, "  ", "  ")
-			w.Write(retval)
 		}
+		render(w, req, cardsOutput)
+	}
+}
+
+func cardFrom(g gjson.GenJson) card {
+	return card{
+		Id:      g.StringOrEmpty("id"),
+		Last4:   g.StringOrEmpty("last4"),
+		Balance: g.FloatOrZero("balanceCents") * 0.01,
+		Name:    g.StringOrEmpty("displayName"),
+		Status:  g.StringOrEmpty("status"),
+	}
+}
+
+// fetchCards returns lite views of the virtual cards of the signed in Extend user
+func fetchCards(tok string) ([]card, error) {
+	reqOut, _ := http.NewRequest(http.MethodGet, extendURL("/virtualcards?count=50"), nil)
+	reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	cards, err := extendAPI(reqOut)
+	if err != nil {
+		return nil, err
+	}
+	// retval, _ := json.MarshalIndent(cards, "  ", "  ") // pass through
+	cardsOutput := make([]card, 0)
+	for _, c := range cards.ArrayOrEmpty("virtualCards") {
+		cardsOutput = append(cardsOutput, cardFrom(gjson.FromGeneric(c)))
+	}
+	return cardsOutput, nil
+}
+
+type user struct {
+	Id           string
+	FirstName    string
+	LastName     string
+	Email        string
+	Organization string
+	Roles        []string
+}
+
+func userFrom(g gjson.GenJson) user {
+	u := user{
+		Id:           g.StringOrEmpty("id"),
+		FirstName:    g.StringOrEmpty("firstName"),
+		LastName:     g.StringOrEmpty("lastName"),
+		Email:        g.StringOrEmpty("email"),
+		Organization: g.StringOrEmpty("organization", "name"),
+		Roles:        []string{},
+	}
+	for _, r := range g.ArrayOrEmpty("roles") {
+		if s, ok := r.(string); ok {
+			u.Roles = append(u.Roles, s)
+		}
+	}
+	for _, field := range []string{"role", "organizationRole"} {
+		if r := g.StringOrEmpty(field); r != "" && !contains(u.Roles, r) {
+			u.Roles = append(u.Roles, r)
+		}
+	}
+	return u
+}
+
+// meView describes the caller: the signed in Extend user, the session expiry and what the API-Key may do
+type meView struct {
+	User         user
+	TokenExpires time.Time
+	Client       string
+	Scopes       []string
+	Cards        []string `json:",omitempty"` // empty - every card
+}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/me
+{"User": {"FirstName": "Jane", ...}, "TokenExpires": "2022-04-01T12:00:00Z", "Scopes": ["*"]}
+*/
+func me(w http.ResponseWriter, req *http.Request) {
+	t, err := extendSession(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	k, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
 	}
+	p := permissionsFrom(req)
+	render(w, req, meView{User: userFrom(t.User), TokenExpires: t.Claims.Expires.UTC(), Client: k.Client,
+		Scopes: p.Scopes, Cards: p.Cards})
+}
+
+// fetchRawCard returns a virtual card as returned by Extend
+func fetchRawCard(tok, cardID string) (gjson.GenJson, error) {
+	reqOut, _ := http.NewRequest(http.MethodGet, extendURL("/virtualcards/%s", cardID), nil)
+	reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	g, err := extendAPI(reqOut)
+	if err != nil {
+		return g, err
+	}
+	return g.UnwindOrNil("virtualCard"), nil
 }
 
 type tx struct {
-	Id      string
-	Amount  float64
-	Name    string
-	Status  string
-	Updated string
+	Id         string
+	Amount     float64
+	Name       string
+	Status     string
+	Updated    string
+	Annotation *annotation `json:",omitempty"`
+	Alert      *alert      `json:",omitempty"`
 }
 
 /*
-$ curl -H "API-Key: xxx" http://localhost:8008/cards/XXX/transactions
+$ curl -H "API-Key: xxx" "http://localhost:8008/cards/XXX/transactions?tag=client-x&category=Travel"
 []
 */
 func listTransactions(w http.ResponseWriter, req *http.Request) {
+	card := mux.Vars(req)["card"]
 	if tok, err := signin(req); err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusUnauthorized)
+	} else if txsOutput, err := fetchTransactions(tok, card); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
 	} else {
-		params := mux.Vars(req)
-		reqOut, _ := http.NewRequest(http.MethodGet,
-			fmt.Sprintf("https://api.paywithextend.com/virtualcards/%s/transactions?status=PENDING,CLEARED,DECLINED&count=500", params["card"]), nil)
-		reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
-		if txs, err := extendAPI(reqOut); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusUnauthorized)
-		} else {
-			// retval, _ := json.MarshalIndent(cards, "  ", "  ") pass all_3_passthrough
-			txsOutput := make([]tx, 0)
-			for _, t := range txs.ArrayOrEmpty("transactions") {
-				g := gjson.FromGeneric(t)
-				txsOutput = append(txsOutput,
-					tx{
-						Id:      g.StringOrEmpty("id"),
-						Amount:  g.FloatOrZero("authBillingAmountCents") * 0.01,
-						Name:    g.StringOrEmpty("merchantName"),
-						Status:  g.StringOrEmpty("status"),
-						Updated: g.StringOrEmpty("updatedAt"),
-					})
-			}
-			retval, _ := json.MarshalIndent(txsOutput, "  ", "  ")
-			w.Write(retval)
-		}
+		render(w, req, withAlerts(card, annotate(card, txsOutput, req.URL.Query()["tag"], req.URL.Query().Get("category"))))
+	}
+}
+
+func txFrom(g gjson.GenJson) tx {
+	return tx{
+		Id:      g.StringOrEmpty("id"),
+		Amount:  g.FloatOrZero("authBillingAmountCents") * 0.01,
+		Name:    g.StringOrEmpty("merchantName"),
+		Status:  g.StringOrEmpty("status"),
+		Updated: g.StringOrEmpty("updatedAt"),
+	}
+}
+
+// fetchTransactions returns lite views of pending, cleared and declined transactions of a card
+func fetchTransactions(tok, cardID string) ([]tx, error) {
+	txs, err := fetchRawTransactions(tok, cardID)
+	if err != nil {
+		return nil, err
+	}
+	// retval, _ := json.MarshalIndent(cards, "  ", "  ") pass all_3_passthrough
+	txsOutput := make([]tx, 0)
+	for _, g := range txs {
+		txsOutput = append(txsOutput, txFrom(g))
+	}
+	return txsOutput, nil
+}
+
+// fetchRawTransactions returns pending, cleared and declined transactions of a card as Extend lists them
+func fetchRawTransactions(tok, cardID string) ([]gjson.GenJson, error) {
+	reqOut, _ := http.NewRequest(http.MethodGet,
+		extendURL("/virtualcards/%s/transactions?status=PENDING,CLEARED,DECLINED&count=500", cardID), nil)
+	reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	txs, err := extendAPI(reqOut)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]gjson.GenJson, 0)
+	for _, t := range txs.ArrayOrEmpty("transactions") {
+		retval = append(retval, gjson.FromGeneric(t))
 	}
+	return retval, nil
 }
 
 /*
@@ -191,58 +372,132 @@ func details(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
 	} else {
 		params := mux.Vars(req)
-		reqOut, _ := http.NewRequest(http.MethodGet,
-			fmt.Sprintf("https://api.paywithextend.com/transactions/%s", params["transaction"]), nil)
-		reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
-		if cards, err := extendAPI(reqOut); err != nil {
+		if cards, err := fetchTransaction(tok, params["transaction"]); err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusUnauthorized)
+		} else if perms := permissionsFrom(req); perms.restricted() &&
+			!perms.allowsCard(cards.StringOrEmpty("virtualCardId")) {
+			log.Printf("transaction '%s' belongs to a card the api-Key has no access to", params["transaction"])
+			w.WriteHeader(http.StatusForbidden)
 		} else {
-			retval, _ := json.MarshalIndent(cards, "  ", "  ")
-			w.Write(retval)
+			if a, err := transactionAnnotation(params["transaction"]); err != nil {
+				log.Println(err)
+			} else if a != nil {
+				cards.Set(a, "annotation")
+			}
+			if a, err := transactionAlert(params["transaction"]); err != nil {
+				log.Println(err)
+			} else if a != nil {
+				cards.Set(a, "alert")
+			}
+			render(w, req, cards)
 		}
 	}
 
 }
 
+// fetchTransaction returns a transaction as Extend describes it
+func fetchTransaction(tok, id string) (gjson.GenJson, error) {
+	reqOut, _ := http.NewRequest(http.MethodGet,
+		extendURL("/transactions/%s", id), nil)
+	reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	return extendAPI(reqOut)
+}
+
 type token struct {
-	Token string
-	User  gjson.GenJson
+	Token    string
+	User     gjson.GenJson
+	Claims   extendClaims
+	Account  string
+	signedIn time.Time
 }
 
-var cache = make(map[string]token)
+// sessionKey identifies a cached Extend session: an API-Key signed in to one of the accounts of its client
+type sessionKey struct{ apiKey, account string }
+
+var (
+	cache   = make(map[sessionKey]token)
+	cacheMu sync.Mutex
+)
 
 func signin(req *http.Request) (string, error) {
-	apiKey := req.Header.Get("API-Key")
+	t, err := extendSession(req)
+	return t.Token, err
+}
+
+// session returns the Extend session of the primary account of apiKey
+func session(apiKey string) (token, error) {
+	return accountSession(apiKey, primaryAccount)
+}
+
+// accountSession returns the Extend session of apiKey for acct signing in when there is no valid one
+func accountSession(apiKey, acct string) (token, error) {
+	var t token
+	apiKey = strings.TrimSpace(apiKey)
 	if apiKey == "" {
-		return "", errors.New("api-Key is not specified!")
+		return t, errors.New("api-Key is not specified!")
 	}
-	t, ok := cache[apiKey]
-	if !ok || expirationTime(t.Token).Before(time.Now().UTC()) {
-		data, err := persistense.Query("SELECT email, password FROM clients WHERE api_key=$1", strings.TrimSpace(apiKey))
-		if err != nil {
-			return "", fmt.Errorf("api-Key is not found: %s", err)
-		}
-		if len(data) == 0 {
-			return "", fmt.Errorf("api-Key is not found")
-		}
-		reqOut, err := http.NewRequest(http.MethodPost, "https://api.paywithextend.com/signin",
-			strings.NewReader(fmt.Sprintf(`{ "email": "%s", "password": "%s" }`, data[0][0], data[0][1])))
-		g, err := extendAPI(reqOut)
-		if err != nil {
-			return "", err
-		}
-		t = token{Token: g.StringOrEmpty("token"), User: g.UnwindOrNil("user")}
-		cache[apiKey] = t
+	k, err := lookupKey(apiKey)
+	if err != nil {
+		return t, err
+	} else if err := k.check(time.Now()); err != nil {
+		return t, err
+	}
+	cacheMu.Lock()
+	t, ok := cache[sessionKey{apiKey, acct}]
+	cacheMu.Unlock()
+	now := time.Now()
+	if ok && t.Claims.fresh(now) && !t.signedIn.Before(k.Flushed) {
+		sessionStats.Add("reused", 1)
+		return t, nil
+	}
+	email, password, err := accountLogin(k, acct)
+	if err != nil {
+		return t, err
+	}
+	if t, err = extendSignin(email, password, now); err != nil {
+		return t, err
+	}
+	t.Account = acct
+	cacheMu.Lock()
+	cache[sessionKey{apiKey, acct}] = t
+	cacheMu.Unlock()
+	return t, nil
+}
+
+// extendSignin signs in to Extend with a login
+func extendSignin(email, password string, now time.Time) (token, error) {
+	body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	reqOut, _ := http.NewRequest(http.MethodPost, extendURL("/signin"), bytes.NewReader(body))
+	g, err := extendAPI(reqOut)
+	if err != nil {
+		sessionStats.Add("signin_errors", 1)
+		return token{}, err
+	}
+	claims, err := parseExtendToken(g.StringOrEmpty("token"), now)
+	if err != nil {
+		sessionStats.Add("invalid_tokens", 1)
+		return token{}, fmt.Errorf("invalid Extend session token: %v", err)
 	}
-	return t.Token, nil
+	sessionStats.Add("signins", 1)
+	return token{Token: g.StringOrEmpty("token"), User: g.UnwindOrNil("user"), Claims: claims, signedIn: now}, nil
+}
+
+// extendURL returns the url of an Extend API path, format and args are those of fmt.Sprintf
+func extendURL(format string, args ...interface{}) string {
+	return strings.TrimRight(*extendBase, "/") + fmt.Sprintf(format, args...)
 }
 
 func extendAPI(reqOut *http.Request) (gjson.GenJson, error) {
 	reqOut.Header.Add("Content-Type", "application/json")
-	reqOut.Header.Add("Accept", "application/vnd.paywithextend.v2021-03-12+json")
+	reqOut.Header.Add("Accept", fmt.Sprintf("application/vnd.paywithextend.v%s+json", *extendVersion))
+	transport, err := upstream()
+	if err != nil {
+		return gjson.FromGeneric(nil), err
+	}
 	client := &http.Client{
-		Timeout: time.Second * 10,
+		Transport: transport,
+		Timeout:   *extendTimeout,
 	}
 	resp, err := client.Do(reqOut)
 	if err != nil {
@@ -259,28 +514,3 @@ func extendAPI(reqOut *http.Request) (gjson.GenJson, error) {
 	}
 	return retval, nil
 }
-
-var epoch = time.Unix(0, 0)
-
-func expirationTime(tok string) time.Time {
-	if strings.TrimSpace(tok) == "" {
-		log.Println(errors.New("empty token - cannot find expiration time"))
-		return epoch
-	}
-	parts := strings.Split(tok, ".")
-	if len(parts) != 3 {
-		log.Println(fmt.Errorf("incorrectly formatted token - cannot find expiration time '%s'", tok))
-		return epoch
-	}
-	var g gjson.GenJson
-	if err := json.Unmarshal([]byte(parts[1]), &g); err != nil {
-		log.Println(err)
-		return epoch
-	}
-	if sec, err := g.Int("exp"); err != nil {
-		log.Println(err)
-		return epoch
-	} else {
-		return time.Unix(int64(sec), 0)
-	}
-}
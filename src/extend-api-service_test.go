@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/json"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	"reflect"
+	"testing"
+)
+
+func TestUserFrom(t *testing.T) {
+	var g gjson.GenJson
+	json.Unmarshal([]byte(`{"id": "u1", "firstName": "Jane", "lastName": "Doe", "email": "jane@example.com",
+		"organization": {"id": "o1", "name": "Acme"}, "roles": ["ADMIN", "MEMBER"], "organizationRole": "ADMIN"}`), &g)
+	u := userFrom(g)
+	if u.Id != "u1" || u.FirstName != "Jane" || u.Organization != "Acme" || !reflect.DeepEqual(u.Roles, []string{"ADMIN", "MEMBER"}) {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if u := userFrom(gjson.FromGeneric(nil)); u.Roles == nil || len(u.Roles) != 0 {
+		t.Errorf("roles of an unknown user should be an empty list, got %v", u.Roles)
+	}
+}
@@ -0,0 +1,249 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: extend.proto
+
+package extendpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ExtendAPIClient is the client API for ExtendAPI service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ExtendAPIClient interface {
+	// requires cards:read
+	ListCards(ctx context.Context, in *ListCardsRequest, opts ...grpc.CallOption) (*ListCardsResponse, error)
+	// requires transactions:read
+	ListTransactions(ctx context.Context, in *ListTransactionsRequest, opts ...grpc.CallOption) (*ListTransactionsResponse, error)
+	// requires transactions:read
+	GetTransaction(ctx context.Context, in *GetTransactionRequest, opts ...grpc.CallOption) (*Transaction, error)
+	// requires transactions:read, streams new transactions and status changes of a card
+	WatchTransactions(ctx context.Context, in *WatchTransactionsRequest, opts ...grpc.CallOption) (ExtendAPI_WatchTransactionsClient, error)
+}
+
+type extendAPIClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewExtendAPIClient(cc grpc.ClientConnInterface) ExtendAPIClient {
+	return &extendAPIClient{cc}
+}
+
+func (c *extendAPIClient) ListCards(ctx context.Context, in *ListCardsRequest, opts ...grpc.CallOption) (*ListCardsResponse, error) {
+	out := new(ListCardsResponse)
+	err := c.cc.Invoke(ctx, "/extend.v1.ExtendAPI/ListCards", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *extendAPIClient) ListTransactions(ctx context.Context, in *ListTransactionsRequest, opts ...grpc.CallOption) (*ListTransactionsResponse, error) {
+	out := new(ListTransactionsResponse)
+	err := c.cc.Invoke(ctx, "/extend.v1.ExtendAPI/ListTransactions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *extendAPIClient) GetTransaction(ctx context.Context, in *GetTransactionRequest, opts ...grpc.CallOption) (*Transaction, error) {
+	out := new(Transaction)
+	err := c.cc.Invoke(ctx, "/extend.v1.ExtendAPI/GetTransaction", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *extendAPIClient) WatchTransactions(ctx context.Context, in *WatchTransactionsRequest, opts ...grpc.CallOption) (ExtendAPI_WatchTransactionsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ExtendAPI_ServiceDesc.Streams[0], "/extend.v1.ExtendAPI/WatchTransactions", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &extendAPIWatchTransactionsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ExtendAPI_WatchTransactionsClient interface {
+	Recv() (*TransactionEvent, error)
+	grpc.ClientStream
+}
+
+type extendAPIWatchTransactionsClient struct {
+	grpc.ClientStream
+}
+
+func (x *extendAPIWatchTransactionsClient) Recv() (*TransactionEvent, error) {
+	m := new(TransactionEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ExtendAPIServer is the server API for ExtendAPI service.
+// All implementations must embed UnimplementedExtendAPIServer
+// for forward compatibility
+type ExtendAPIServer interface {
+	// requires cards:read
+	ListCards(context.Context, *ListCardsRequest) (*ListCardsResponse, error)
+	// requires transactions:read
+	ListTransactions(context.Context, *ListTransactionsRequest) (*ListTransactionsResponse, error)
+	// requires transactions:read
+	GetTransaction(context.Context, *GetTransactionRequest) (*Transaction, error)
+	// requires transactions:read, streams new transactions and status changes of a card
+	WatchTransactions(*WatchTransactionsRequest, ExtendAPI_WatchTransactionsServer) error
+	mustEmbedUnimplementedExtendAPIServer()
+}
+
+// UnimplementedExtendAPIServer must be embedded to have forward compatible implementations.
+type UnimplementedExtendAPIServer struct {
+}
+
+func (UnimplementedExtendAPIServer) ListCards(context.Context, *ListCardsRequest) (*ListCardsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCards not implemented")
+}
+func (UnimplementedExtendAPIServer) ListTransactions(context.Context, *ListTransactionsRequest) (*ListTransactionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTransactions not implemented")
+}
+func (UnimplementedExtendAPIServer) GetTransaction(context.Context, *GetTransactionRequest) (*Transaction, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTransaction not implemented")
+}
+func (UnimplementedExtendAPIServer) WatchTransactions(*WatchTransactionsRequest, ExtendAPI_WatchTransactionsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchTransactions not implemented")
+}
+func (UnimplementedExtendAPIServer) mustEmbedUnimplementedExtendAPIServer() {}
+
+// UnsafeExtendAPIServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ExtendAPIServer will
+// result in compilation errors.
+type UnsafeExtendAPIServer interface {
+	mustEmbedUnimplementedExtendAPIServer()
+}
+
+func RegisterExtendAPIServer(s grpc.ServiceRegistrar, srv ExtendAPIServer) {
+	s.RegisterService(&ExtendAPI_ServiceDesc, srv)
+}
+
+func _ExtendAPI_ListCards_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCardsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExtendAPIServer).ListCards(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/extend.v1.ExtendAPI/ListCards",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExtendAPIServer).ListCards(ctx, req.(*ListCardsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ExtendAPI_ListTransactions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTransactionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExtendAPIServer).ListTransactions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/extend.v1.ExtendAPI/ListTransactions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExtendAPIServer).ListTransactions(ctx, req.(*ListTransactionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ExtendAPI_GetTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExtendAPIServer).GetTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/extend.v1.ExtendAPI/GetTransaction",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExtendAPIServer).GetTransaction(ctx, req.(*GetTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ExtendAPI_WatchTransactions_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchTransactionsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ExtendAPIServer).WatchTransactions(m, &extendAPIWatchTransactionsServer{stream})
+}
+
+type ExtendAPI_WatchTransactionsServer interface {
+	Send(*TransactionEvent) error
+	grpc.ServerStream
+}
+
+type extendAPIWatchTransactionsServer struct {
+	grpc.ServerStream
+}
+
+func (x *extendAPIWatchTransactionsServer) Send(m *TransactionEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ExtendAPI_ServiceDesc is the grpc.ServiceDesc for ExtendAPI service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ExtendAPI_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "extend.v1.ExtendAPI",
+	HandlerType: (*ExtendAPIServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListCards",
+			Handler:    _ExtendAPI_ListCards_Handler,
+		},
+		{
+			MethodName: "ListTransactions",
+			Handler:    _ExtendAPI_ListTransactions_Handler,
+		},
+		{
+			MethodName: "GetTransaction",
+			Handler:    _ExtendAPI_GetTransaction_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchTransactions",
+			Handler:       _ExtendAPI_WatchTransactions_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "extend.proto",
+}
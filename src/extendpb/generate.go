@@ -0,0 +1,4 @@
+// Package extendpb contains gRPC bindings of the service generated from extend.proto
+package extendpb
+
+//go:generate buf generate
@@ -0,0 +1,8 @@
+module github.com/tbolsh/extend-go-nginx-postgres-docker/extendpb
+
+go 1.16
+
+require (
+	google.golang.org/grpc v1.46.2
+	google.golang.org/protobuf v1.27.1
+)
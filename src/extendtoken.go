@@ -0,0 +1,102 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/tbolsh/extend-go-nginx-postgres-docker/jwt"
+	"net/http"
+	"time"
+)
+
+var (
+	clockSkew      = flag.Duration("clock-skew", 30*time.Second, "tolerated clock difference with Extend and the IdP; Extend sessions are renewed this long before their token expires")
+	extendJWKSFile = flag.String("extend-jwks", "", "JWKS file with keys verifying Extend session tokens, not verified by default")
+
+	extendKeys = jwt.NewKeys()
+)
+
+// sessionFallbackTTL is the lifetime of an Extend session whose token has no "exp" claim
+const sessionFallbackTTL = 15 * time.Minute
+
+// extendClaims of an Extend session token
+type extendClaims struct {
+	Subject  string
+	IssuedAt time.Time
+	Expires  time.Time
+}
+
+// parseExtendToken decodes an Extend session token, its signature is verified when -extend-jwks is set
+func parseExtendToken(raw string, now time.Time) (extendClaims, error) {
+	tok, err := jwt.Parse(raw)
+	if err != nil {
+		return extendClaims{}, err
+	}
+	if extendKeys.Len() > 0 {
+		if err := extendKeys.Verify(tok); err != nil {
+			return extendClaims{}, err
+		}
+	}
+	c := extendClaims{Subject: tok.String("sub"), IssuedAt: tok.Time("iat"), Expires: tok.Time("exp")}
+	if c.Expires.IsZero() {
+		c.Expires = now.Add(sessionFallbackTTL)
+	}
+	return c, tok.ValidAt(now, *clockSkew)
+}
+
+// fresh reports whether a session can still be used at now, it is renewed -clock-skew before it expires
+func (c extendClaims) fresh(now time.Time) bool {
+	return now.Add(*clockSkew).Before(c.Expires)
+}
+
+// extendSession returns the Extend session of the request's API-Key together with its token claims, requests
+// about a card get the session of the account the card belongs to
+func extendSession(req *http.Request) (token, error) {
+	return cardSession(requestKey(req), mux.Vars(req)["card"])
+}
+
+// sessionStats are published at /metrics along with the claims of cached sessions
+var sessionStats = expvar.NewMap("extend_sessions")
+
+func init() {
+	expvar.Publish("extend_tokens", expvar.Func(func() interface{} {
+		now := time.Now()
+		cacheMu.Lock()
+		defer cacheMu.Unlock()
+		tokens := make(map[string]interface{}, len(cache))
+		for k, t := range cache {
+			tokens[keyPrefix(k.apiKey)+"/"+k.account] = map[string]interface{}{
+				"subject":   t.Claims.Subject,
+				"issuedAt":  t.Claims.IssuedAt.UTC(),
+				"expires":   t.Claims.Expires.UTC(),
+				"expiresIn": int64(t.Claims.Expires.Sub(now).Seconds()),
+			}
+		}
+		return tokens
+	}))
+}
+
+// hiddenMetrics are expvar variables /metrics leaves out, cmdline would show secrets given as flags
+var hiddenMetrics = map[string]bool{"cmdline": true}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/metrics
+{"extend_sessions": {"signins": 3, "reused": 120}, "extend_tokens": {...}, "memstats": {...}}
+*/
+func metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if hiddenMetrics[kv.Key] {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",")
+		}
+		first = false
+		fmt.Fprintf(w, "\n%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func extendToken(claims map[string]interface{}) string {
+	seg := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	return seg(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + seg(claims) + ".c2ln"
+}
+
+func TestParseExtendToken(t *testing.T) {
+	now := time.Now()
+	c, err := parseExtendToken(extendToken(map[string]interface{}{"sub": "u1", "iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix()}), now)
+	if err != nil || c.Subject != "u1" || c.Expires.Unix() != now.Add(time.Hour).Unix() || c.IssuedAt.Unix() != now.Unix() {
+		t.Fatalf("unexpected claims %+v, %v", c, err)
+	}
+	if !c.fresh(now) || c.fresh(now.Add(time.Hour-*clockSkew/2)) {
+		t.Errorf("session should be fresh now and renewed within -clock-skew of expiry")
+	}
+	if _, err := parseExtendToken(extendToken(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), now); err == nil {
+		t.Error("expired token should not be accepted")
+	}
+	c, err = parseExtendToken(extendToken(map[string]interface{}{"sub": "u1"}), now)
+	if err != nil || !c.Expires.Equal(now.Add(sessionFallbackTTL)) {
+		t.Errorf("token without exp should expire after %v, got %+v %v", sessionFallbackTTL, c, err)
+	}
+	if _, err := parseExtendToken("not-a-token", now); err == nil {
+		t.Error("malformed token should not be accepted")
+	}
+}
+
+func TestMetricsHideCmdline(t *testing.T) {
+	rec := httptest.NewRecorder()
+	metrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("metrics should be json: %v\n%s", err, rec.Body)
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("cmdline may carry secrets and should not be served")
+	}
+	if _, ok := vars["extend_sessions"]; !ok {
+		t.Errorf("extend_sessions expected, got %s", rec.Body)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var extendFixtures = flag.String("extend-fixtures", "", "record[:dir] saves sanitized Extend API exchanges as fixture files, replay[:dir] answers Extend API requests from them instead of calling Extend")
+
+// fixture is a sanitized Extend API exchange, Authorization and other headers are never stored
+type fixture struct {
+	Method       string
+	Path         string          // path and query of the request
+	Request      json.RawMessage `json:",omitempty"`
+	Status       int
+	ContentType  string          `json:",omitempty"`
+	Response     json.RawMessage `json:",omitempty"`
+	ResponseText string          `json:",omitempty"` // body of a response that is not json
+}
+
+// fixtureModes are constructors of Extend transports by -extend-fixtures mode
+var fixtureModes = map[string]func(dir string, next http.RoundTripper) http.RoundTripper{
+	"record": func(dir string, next http.RoundTripper) http.RoundTripper {
+		return &recorder{dir: dir, next: next, seq: fixtureSeq{n: map[string]int{}}}
+	},
+	"replay": func(dir string, next http.RoundTripper) http.RoundTripper {
+		return &replayer{dir: dir, seq: fixtureSeq{n: map[string]int{}}}
+	},
+}
+
+// newExtendTransport returns the transport of Extend API requests, next unless -extend-fixtures is set
+func newExtendTransport(mode string, next http.RoundTripper) (http.RoundTripper, error) {
+	if mode == "" {
+		return next, nil
+	}
+	parts := strings.SplitN(mode, ":", 2)
+	newTransport, ok := fixtureModes[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown fixture mode '%s', should be record or replay", parts[0])
+	}
+	dir := ""
+	if len(parts) > 1 {
+		dir = parts[1]
+	}
+	if dir == "" {
+		dir = pathf("fixtures")
+	}
+	return newTransport(dir, next), nil
+}
+
+var (
+	extendTransportOnce sync.Once
+	extendTransport     http.RoundTripper
+	extendTransportErr  error
+)
+
+// upstream returns the transport of Extend API requests configured by -extend-fixtures
+func upstream() (http.RoundTripper, error) {
+	extendTransportOnce.Do(func() {
+		extendTransport, extendTransportErr = newExtendTransport(*extendFixtures, http.DefaultTransport)
+	})
+	return extendTransport, extendTransportErr
+}
+
+// fixtureSeq numbers repeated requests, so polling the same path records and replays every answer in order
+type fixtureSeq struct {
+	sync.Mutex
+	n map[string]int
+}
+
+func (s *fixtureSeq) next(key string) int {
+	s.Lock()
+	defer s.Unlock()
+	s.n[key]++
+	return s.n[key]
+}
+
+func fixtureFile(dir, key string, n int) string {
+	if n == 1 {
+		return filepath.Join(dir, key+".json")
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.%d.json", key, n))
+}
+
+var nonSlug = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// fixtureKey names the fixtures of a request after its method, path and a hash of its sanitized body
+func fixtureKey(method, path string, body json.RawMessage) string {
+	sum := sha256.Sum256([]byte(method + " " + path + "\n" + string(body)))
+	slug := strings.Trim(nonSlug.ReplaceAllString(path, "-"), "-")
+	if len(slug) > 80 {
+		slug = slug[:80]
+	}
+	return fmt.Sprintf("%s_%s_%s", strings.ToLower(method), slug, hex.EncodeToString(sum[:4]))
+}
+
+// requestFixture reads and restores the body of req, it returns the sanitized request
+func requestFixture(req *http.Request) (fixture, error) {
+	f := fixture{Method: req.Method, Path: req.URL.RequestURI()}
+	if req.Body == nil {
+		return f, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return f, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		return f, nil
+	}
+	if f.Request = sanitize(body); f.Request == nil {
+		// multipart uploads and the like only leave a trace of their type
+		f.Request, _ = json.Marshal(fmt.Sprintf("%s body", req.Header.Get("Content-Type")))
+	}
+	return f, nil
+}
+
+// recorder passes requests to Extend and saves every exchange to dir
+type recorder struct {
+	dir  string
+	next http.RoundTripper
+	seq  fixtureSeq
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, err := requestFixture(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	f.Status, f.ContentType = resp.StatusCode, resp.Header.Get("Content-Type")
+	if f.Response = sanitize(body); f.Response == nil {
+		f.ResponseText = scrubPANs(string(body))
+	}
+	key := fixtureKey(f.Method, f.Path, f.Request)
+	if err := writeFixture(fixtureFile(r.dir, key, r.seq.next(key)), f); err != nil {
+		log.Printf("recording %s %s: %v", f.Method, f.Path, err)
+	}
+	return resp, nil
+}
+
+func writeFixture(name string, f fixture) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, append(b, '\n'), 0600)
+}
+
+// replayer answers requests with the fixtures recorded for them, once they run out the last one is repeated
+type replayer struct {
+	dir string
+	seq fixtureSeq
+}
+
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, err := requestFixture(req)
+	if err != nil {
+		return nil, err
+	}
+	key := fixtureKey(f.Method, f.Path, f.Request)
+	for n := r.seq.next(key); n > 0; n-- {
+		b, err := ioutil.ReadFile(fixtureFile(r.dir, key, n))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var recorded fixture
+		if err := json.Unmarshal(b, &recorded); err != nil {
+			return nil, fmt.Errorf("fixture %s: %v", fixtureFile(r.dir, key, n), err)
+		}
+		body := []byte(recorded.Response)
+		if recorded.Response == nil {
+			body = []byte(recorded.ResponseText)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+			StatusCode:    recorded.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{recorded.ContentType}},
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no fixture %s for %s %s", fixtureFile(r.dir, key, 1), f.Method, f.Path)
+}
+
+// fixtureToken replaces Extend session tokens: it parses, has no signature and no expiry, see sessionFallbackTTL
+var fixtureToken = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+	base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"fixture"}`)) + "."
+
+const redacted = "REDACTED"
+
+// sanitize scrubs credentials and card numbers out of a json body, it returns nil for bodies that are not json
+func sanitize(body []byte) json.RawMessage {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil
+	}
+	b, err := json.Marshal(scrub("", v))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func scrub(key string, v interface{}) interface{} {
+	k := strings.ToLower(key)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			v[name] = scrub(name, value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = scrub(key, value)
+		}
+		return v
+	case string:
+		switch {
+		case strings.Contains(k, "token"):
+			return fixtureToken
+		case strings.Contains(k, "password") || strings.Contains(k, "secret") || k == "cvv" || k == "cvc" || k == "securitycode":
+			return redacted
+		case k == "email":
+			return "user@example.com"
+		case k == "pan" || k == "vcn" || k == "cardnumber":
+			return maskPAN(v)
+		}
+		return scrubPANs(v)
+	}
+	return v
+}
+
+var panPattern = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+
+// scrubPANs masks card numbers, sequences of 13-19 digits passing the Luhn check, in s
+func scrubPANs(s string) string {
+	return panPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if luhn(digits(m)) {
+			return maskPAN(m)
+		}
+		return m
+	})
+}
+
+// maskPAN keeps the last 4 digits of a card number
+func maskPAN(pan string) string {
+	d := digits(pan)
+	if len(d) <= 4 {
+		return redacted
+	}
+	return strings.Repeat("*", len(d)-4) + d[len(d)-4:]
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func luhn(d string) bool {
+	sum := 0
+	for i := range d {
+		n := int(d[len(d)-1-i] - '0')
+		if i%2 == 1 {
+			if n *= 2; n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return len(d) > 0 && sum%10 == 0
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	polls := 0
+	extend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/signin":
+			w.Write([]byte(`{"token": "eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiJ1c2VyIn0.c2ln", "user": {"email": "jane@corp.com", "id": "u_1"}}`))
+		case "/virtualcards":
+			polls++
+			w.Write([]byte(`{"virtualCards": [{"id": "vc_1", "vcn": "4111111111111111", "cvv": "123", "balanceCents": ` +
+				map[bool]string{true: "100", false: "250"}[polls == 1] + `, "notes": "paid with 4111 1111 1111 1111"}]}`))
+		}
+	}))
+	defer extend.Close()
+	exchange := func(rt http.RoundTripper, method, path, body string) (int, string, error) {
+		req, _ := http.NewRequest(method, extend.URL+path, strings.NewReader(body))
+		resp, err := (&http.Client{Transport: rt}).Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.Join(strings.Fields(string(b)), ""), nil
+	}
+
+	rec, err := newExtendTransport("record:"+dir, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body, err := exchange(rec, http.MethodPost, "/signin", `{"email": "jane@corp.com", "password": "hunter2"}`); err != nil || !strings.Contains(body, "jane@corp.com") {
+		t.Fatalf("recording should pass Extend's answer through, got %s (%v)", body, err)
+	}
+	exchange(rec, http.MethodGet, "/virtualcards", "")
+	exchange(rec, http.MethodGet, "/virtualcards", "")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 3 {
+		t.Fatalf("a fixture per exchange expected, got %v", files)
+	}
+	for _, f := range files {
+		b, _ := ioutil.ReadFile(f)
+		for _, secret := range []string{"hunter2", "jane@corp.com", "4111111111111111", "4111 1111 1111 1111", `"123"`, "c2ln"} {
+			if strings.Contains(string(b), secret) {
+				t.Errorf("%s leaks %s:\n%s", f, secret, b)
+			}
+		}
+	}
+
+	replay, err := newExtendTransport("replay:"+dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body, err := exchange(replay, http.MethodPost, "/signin", `{"email": "other@corp.com", "password": "other"}`)
+	var signin struct{ Token string }
+	if err != nil || status != http.StatusOK || json.Unmarshal([]byte(body), &signin) != nil {
+		t.Fatalf("signin should replay with any credentials, got %d %s (%v)", status, body, err)
+	}
+	if _, err := parseExtendToken(signin.Token, time.Now()); err != nil {
+		t.Errorf("replayed session token should parse: %v", err)
+	}
+	for i, balance := range []string{`"balanceCents":100`, `"balanceCents":250`, `"balanceCents":250`} {
+		if _, body, err := exchange(replay, http.MethodGet, "/virtualcards", ""); err != nil || !strings.Contains(body, balance) ||
+			!strings.Contains(body, "************1111") {
+			t.Errorf("poll %d should replay %s, got %s (%v)", i+1, balance, body, err)
+		}
+	}
+	if _, _, err := exchange(replay, http.MethodGet, "/transactions/tx_1", ""); err == nil {
+		t.Error("a request that was not recorded should fail")
+	}
+}
+
+func TestScrubPANs(t *testing.T) {
+	for in, expected := range map[string]string{
+		"card 5500-0000-0000-0004 declined": "card ************0004 declined",
+		"order 1234567890123":               "order 1234567890123", // fails the Luhn check
+		"at 1617235200000":                  "at 1617235200000",
+	} {
+		if got := scrubPANs(in); got != expected {
+			t.Errorf("scrubPANs(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
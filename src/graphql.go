@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	graphql "github.com/graph-gophers/graphql-go"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	# signed in Extend user
+	me: User
+	cards: [Card!]!
+	card(id: ID!): Card
+	transaction(id: ID!): Transaction
+}
+
+type User {
+	id: ID!
+	firstName: String!
+	lastName: String!
+	email: String!
+	organization: String!
+}
+
+type Card {
+	id: ID!
+	last4: String!
+	balance: Float!
+	name: String!
+	status: String!
+	transactions(filter: TransactionFilter): [Tx!]!
+}
+
+input TransactionFilter {
+	status: [String!]
+	merchant: String
+	minAmount: Float
+	maxAmount: Float
+	# RFC3339, transactions updated at or after
+	updatedSince: String
+}
+
+type Tx {
+	id: ID!
+	amount: Float!
+	name: String!
+	status: String!
+	updated: String!
+	details: Transaction
+}
+
+type Transaction {
+	id: ID!
+	cardId: String!
+	merchantName: String!
+	amount: Float!
+	currency: String!
+	status: String!
+	authedAt: String!
+	updatedAt: String!
+	# transaction as returned by Extend
+	raw: String!
+}
+`
+
+var gqlSchema = graphql.MustParseSchema(graphqlSchema, &gqlQuery{})
+
+// loader memoizes upstream calls of a single GraphQL request so each card list,
+// transaction list or transaction is fetched once however many fields need it
+type loader struct {
+	token  token // of the primary account
+	apiKey string
+	perms  permissions
+	mu     sync.Mutex
+	calls  map[string]*loaderCall
+}
+
+type loaderCall struct {
+	once sync.Once
+	val  interface{}
+	err  error
+}
+
+type loaderCtx struct{}
+
+func loaderFrom(ctx context.Context) *loader { return ctx.Value(loaderCtx{}).(*loader) }
+
+func (l *loader) do(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	l.mu.Lock()
+	c, ok := l.calls[key]
+	if !ok {
+		c = &loaderCall{}
+		l.calls[key] = c
+	}
+	l.mu.Unlock()
+	c.once.Do(func() { c.val, c.err = fetch() })
+	return c.val, c.err
+}
+
+func (l *loader) cards() ([]card, error) {
+	if !l.perms.allows(scopeCardsRead) {
+		return nil, fmt.Errorf("api-Key has no '%s' scope", scopeCardsRead)
+	}
+	v, err := l.do("cards", func() (interface{}, error) {
+		cards, _, err := fetchAllCards(l.apiKey)
+		return cards, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]card, 0)
+	for _, c := range v.([]card) {
+		if l.perms.allowsCard(c.Id) {
+			retval = append(retval, c)
+		}
+	}
+	return retval, nil
+}
+
+func (l *loader) transactions(cardID string) ([]tx, error) {
+	if !l.perms.allows(scopeTransactionsRead) {
+		return nil, fmt.Errorf("api-Key has no '%s' scope", scopeTransactionsRead)
+	}
+	if !l.perms.allowsCard(cardID) {
+		return nil, fmt.Errorf("api-Key has no access to card '%s'", cardID)
+	}
+	v, err := l.do("transactions/"+cardID, func() (interface{}, error) {
+		t, err := cardSession(l.apiKey, cardID)
+		if err != nil {
+			return nil, err
+		}
+		return fetchTransactions(t.Token, cardID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]tx), nil
+}
+
+func (l *loader) transaction(id string) (gjson.GenJson, error) {
+	if !l.perms.allows(scopeTransactionsRead) {
+		return gjson.FromGeneric(nil), fmt.Errorf("api-Key has no '%s' scope", scopeTransactionsRead)
+	}
+	v, err := l.do("transaction/"+id, func() (interface{}, error) { return fetchTransactionOf(l.apiKey, id) })
+	if err != nil {
+		return gjson.FromGeneric(nil), err
+	}
+	g := v.(gjson.GenJson)
+	if !l.perms.allowsCard(g.StringOrEmpty("virtualCardId")) {
+		return gjson.FromGeneric(nil), fmt.Errorf("api-Key has no access to transaction '%s'", id)
+	}
+	return g, nil
+}
+
+type gqlQuery struct{}
+
+func (gqlQuery) Me(ctx context.Context) *gqlUser {
+	u := loaderFrom(ctx).token.User
+	if u.Empty() {
+		return nil
+	}
+	return &gqlUser{u}
+}
+
+func (gqlQuery) Cards(ctx context.Context) ([]*gqlCard, error) {
+	cards, err := loaderFrom(ctx).cards()
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*gqlCard, len(cards))
+	for i := range cards {
+		retval[i] = &gqlCard{cards[i]}
+	}
+	return retval, nil
+}
+
+func (gqlQuery) Card(ctx context.Context, args struct{ ID graphql.ID }) (*gqlCard, error) {
+	cards, err := loaderFrom(ctx).cards()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cards {
+		if c.Id == string(args.ID) {
+			return &gqlCard{c}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (gqlQuery) Transaction(ctx context.Context, args struct{ ID graphql.ID }) (*gqlTransaction, error) {
+	g, err := loaderFrom(ctx).transaction(string(args.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &gqlTransaction{g}, nil
+}
+
+type gqlUser struct{ gjson.GenJson }
+
+func (u *gqlUser) ID() graphql.ID       { return graphql.ID(u.StringOrEmpty("id")) }
+func (u *gqlUser) FirstName() string    { return u.StringOrEmpty("firstName") }
+func (u *gqlUser) LastName() string     { return u.StringOrEmpty("lastName") }
+func (u *gqlUser) Email() string        { return u.StringOrEmpty("email") }
+func (u *gqlUser) Organization() string { return u.StringOrEmpty("organization", "name") }
+
+type gqlCard struct{ card }
+
+func (c *gqlCard) ID() graphql.ID   { return graphql.ID(c.Id) }
+func (c *gqlCard) Last4() string    { return c.card.Last4 }
+func (c *gqlCard) Balance() float64 { return c.card.Balance }
+func (c *gqlCard) Name() string     { return c.card.Name }
+func (c *gqlCard) Status() string   { return c.card.Status }
+
+type txFilter struct {
+	Status       *[]string
+	Merchant     *string
+	MinAmount    *float64
+	MaxAmount    *float64
+	UpdatedSince *string
+}
+
+func (f *txFilter) match(t tx) bool {
+	if f == nil {
+		return true
+	}
+	if f.Status != nil && !contains(*f.Status, t.Status) {
+		return false
+	}
+	if f.Merchant != nil && !strings.Contains(strings.ToLower(t.Name), strings.ToLower(*f.Merchant)) {
+		return false
+	}
+	if (f.MinAmount != nil && t.Amount < *f.MinAmount) || (f.MaxAmount != nil && t.Amount > *f.MaxAmount) {
+		return false
+	}
+	if f.UpdatedSince != nil {
+		since, err1 := time.Parse(time.RFC3339, *f.UpdatedSince)
+		updated, err2 := time.Parse(time.RFC3339, t.Updated)
+		if err1 == nil && err2 == nil && updated.Before(since) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *gqlCard) Transactions(ctx context.Context, args struct{ Filter *txFilter }) ([]*gqlTx, error) {
+	txs, err := loaderFrom(ctx).transactions(c.Id)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*gqlTx, 0, len(txs))
+	for _, t := range txs {
+		if args.Filter.match(t) {
+			retval = append(retval, &gqlTx{t})
+		}
+	}
+	return retval, nil
+}
+
+type gqlTx struct{ tx }
+
+func (t *gqlTx) ID() graphql.ID  { return graphql.ID(t.Id) }
+func (t *gqlTx) Amount() float64 { return t.tx.Amount }
+func (t *gqlTx) Name() string    { return t.tx.Name }
+func (t *gqlTx) Status() string  { return t.tx.Status }
+func (t *gqlTx) Updated() string { return t.tx.Updated }
+
+func (t *gqlTx) Details(ctx context.Context) (*gqlTransaction, error) {
+	return gqlQuery{}.Transaction(ctx, struct{ ID graphql.ID }{graphql.ID(t.Id)})
+}
+
+type gqlTransaction struct{ gjson.GenJson }
+
+func (t *gqlTransaction) ID() graphql.ID       { return graphql.ID(t.StringOrEmpty("id")) }
+func (t *gqlTransaction) CardId() string       { return t.StringOrEmpty("virtualCardId") }
+func (t *gqlTransaction) MerchantName() string { return t.StringOrEmpty("merchantName") }
+func (t *gqlTransaction) Amount() float64      { return t.FloatOrZero("authBillingAmountCents") * 0.01 }
+func (t *gqlTransaction) Currency() string     { return t.StringOrEmpty("authBillingCurrency") }
+func (t *gqlTransaction) Status() string       { return t.StringOrEmpty("status") }
+func (t *gqlTransaction) AuthedAt() string     { return t.StringOrEmpty("authedAt") }
+func (t *gqlTransaction) UpdatedAt() string    { return t.StringOrEmpty("updatedAt") }
+
+func (t *gqlTransaction) Raw() string {
+	b, _ := t.MarshalJSON()
+	return string(b)
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+/*
+$ curl -H "API-Key: xxx" -d '{"query": "{ me { email } cards { id balance transactions(filter: {status: [\"CLEARED\"]}) { id amount } } }"}' http://localhost:8008/graphql
+{"data": {...}}
+*/
+func graphqlHandler(w http.ResponseWriter, req *http.Request) {
+	var gr graphqlRequest
+	if req.Method == http.MethodGet {
+		gr.Query, gr.OperationName = req.URL.Query().Get("query"), req.URL.Query().Get("operationName")
+		if v := req.URL.Query().Get("variables"); v != "" {
+			json.Unmarshal([]byte(v), &gr.Variables)
+		}
+	} else if err := json.NewDecoder(req.Body).Decode(&gr); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("cannot decode graphql request: %v", err))
+		return
+	}
+	if strings.TrimSpace(gr.Query) == "" {
+		httpError(w, http.StatusBadRequest, errors.New("graphql query is empty"))
+		return
+	}
+	t, err := extendSession(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	l := &loader{token: t, apiKey: requestKey(req), perms: permissionsFrom(req), calls: make(map[string]*loaderCall)}
+	resp := gqlSchema.Exec(context.WithValue(req.Context(), loaderCtx{}, l), gr.Query, gr.OperationName, gr.Variables)
+	retval, _ := json.MarshalIndent(resp, "  ", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(retval)
+}
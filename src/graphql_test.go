@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// preloaded returns a loader whose upstream calls are already made
+func preloaded(perms permissions, vals map[string]interface{}) *loader {
+	l := &loader{perms: perms, calls: make(map[string]*loaderCall)}
+	for k, v := range vals {
+		c := &loaderCall{val: v}
+		c.once.Do(func() {})
+		l.calls[k] = c
+	}
+	return l
+}
+
+func TestGraphqlCardsAndFilter(t *testing.T) {
+	l := preloaded(parsePermissions("*", "vc_1"), map[string]interface{}{
+		"cards": []card{{Id: "vc_1", Name: "one", Balance: 10}, {Id: "vc_2", Name: "two"}},
+		"transactions/vc_1": []tx{
+			{Id: "t1", Amount: 5, Name: "Coffee", Status: "CLEARED"},
+			{Id: "t2", Amount: 50, Name: "Books", Status: "PENDING"},
+			{Id: "t3", Amount: 7, Name: "Coffee", Status: "DECLINED"},
+		},
+	})
+	query := `{ cards { id transactions(filter: {status: ["CLEARED", "PENDING"], maxAmount: 10}) { id name } } }`
+	resp := gqlSchema.Exec(context.WithValue(context.Background(), loaderCtx{}, l), query, "", nil)
+	if len(resp.Errors) > 0 {
+		t.Fatal(resp.Errors)
+	}
+	var data struct {
+		Cards []struct {
+			Id           string
+			Transactions []struct{ Id, Name string }
+		}
+	}
+	json.Unmarshal(resp.Data, &data)
+	if len(data.Cards) != 1 || data.Cards[0].Id != "vc_1" {
+		t.Fatalf("expected only the allowed card, got %s", resp.Data)
+	}
+	if txs := data.Cards[0].Transactions; len(txs) != 1 || txs[0].Id != "t1" {
+		t.Errorf("unexpected filtered transactions %s", resp.Data)
+	}
+}
+
+func TestGraphqlScopes(t *testing.T) {
+	l := preloaded(parsePermissions("transactions:read", ""), nil)
+	resp := gqlSchema.Exec(context.WithValue(context.Background(), loaderCtx{}, l), `{ cards { id } }`, "", nil)
+	if len(resp.Errors) == 0 {
+		t.Errorf("cards should require '%s' scope", scopeCardsRead)
+	}
+}
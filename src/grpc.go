@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/tbolsh/extend-go-nginx-postgres-docker/extendpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"time"
+)
+
+var grpcPort = flag.Int("grpc-port", 9000, "port to serve gRPC on, 0 - disabled")
+
+// scopes required by gRPC methods
+var grpcScopes = map[string]string{
+	"/extend.v1.ExtendAPI/ListCards":         scopeCardsRead,
+	"/extend.v1.ExtendAPI/ListTransactions":  scopeTransactionsRead,
+	"/extend.v1.ExtendAPI/GetTransaction":    scopeTransactionsRead,
+	"/extend.v1.ExtendAPI/WatchTransactions": scopeTransactionsRead,
+}
+
+func serveGRPC() {
+	if *grpcPort == 0 {
+		return
+	}
+	if *grpcPort < 0 || *grpcPort > 65535 {
+		log.Fatalf("gRPC port should be between 0 and 65536 but it is %d", *grpcPort)
+	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *grpcPort))
+	if err != nil {
+		log.Fatal("gRPC Listen: ", err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(grpcUnaryAuth), grpc.StreamInterceptor(grpcStreamAuth))
+	extendpb.RegisterExtendAPIServer(srv, grpcServer{})
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal("gRPC Serve: ", err)
+	}
+}
+
+// grpcAuth authenticates the call like authorize does and returns a context carrying the key and its permissions
+func grpcAuth(ctx context.Context, method string, e *auditEntry) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(name string) string {
+		if v := md.Get(name); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	apiKey, k, err := authenticate(first("api-key"), first("authorization"))
+	if err != nil {
+		log.Println(err)
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+	e.KeyPrefix, e.Client = keyPrefix(k.Key), k.Client
+	if scope := grpcScopes[method]; !k.allows(scope) {
+		return ctx, status.Errorf(codes.PermissionDenied, "api-Key has no '%s' scope", scope)
+	}
+	ctx = context.WithValue(ctx, permissionsKey{}, k.permissions)
+	return context.WithValue(ctx, apiKeyCtx{}, apiKey), nil
+}
+
+func grpcAudit(ctx context.Context, method string) *auditEntry {
+	e := &auditEntry{At: time.Now().UTC(), Method: "GRPC", Route: method}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			e.ClientIP = host
+		}
+	}
+	return e
+}
+
+func queueAudit(e *auditEntry, err error) {
+	e.Status = int(status.Code(err))
+	e.LatencyMs = time.Since(e.At).Milliseconds()
+	queueAuditEntry(*e)
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	e := grpcAudit(ctx, info.FullMethod)
+	if r, ok := req.(interface{ GetCardId() string }); ok {
+		e.Card = r.GetCardId()
+	}
+	if r, ok := req.(interface{ GetTransactionId() string }); ok {
+		e.Transaction = r.GetTransactionId()
+	}
+	ctx, err := grpcAuth(ctx, info.FullMethod, e)
+	var resp interface{}
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	queueAudit(e, err)
+	return resp, err
+}
+
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authStream) Context() context.Context { return s.ctx }
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	e := grpcAudit(ss.Context(), info.FullMethod)
+	ctx, err := grpcAuth(ss.Context(), info.FullMethod, e)
+	if err == nil {
+		err = handler(srv, authStream{ServerStream: ss, ctx: ctx})
+	}
+	queueAudit(e, err)
+	return err
+}
+
+// grpcServer implements extendpb.ExtendAPIServer with the same Extend calls as the HTTP handlers
+type grpcServer struct {
+	extendpb.UnimplementedExtendAPIServer
+}
+
+// grpcSession returns the Extend session of the account card belongs to, the primary one for an empty card
+func grpcSession(ctx context.Context, card string) (string, error) {
+	apiKey, _ := ctx.Value(apiKeyCtx{}).(string)
+	t, err := cardSession(apiKey, card)
+	if err != nil {
+		return "", status.Error(codes.Unauthenticated, err.Error())
+	}
+	return t.Token, nil
+}
+
+func grpcCardAccess(ctx context.Context, card string) error {
+	perms, _ := ctx.Value(permissionsKey{}).(permissions)
+	if !perms.allowsCard(card) {
+		return status.Errorf(codes.PermissionDenied, "api-Key has no access to card '%s'", card)
+	}
+	return nil
+}
+
+func pbTx(t tx) *extendpb.Tx {
+	return &extendpb.Tx{Id: t.Id, Amount: t.Amount, Name: t.Name, Status: t.Status, Updated: t.Updated}
+}
+
+func (grpcServer) ListCards(ctx context.Context, req *extendpb.ListCardsRequest) (*extendpb.ListCardsResponse, error) {
+	apiKey, _ := ctx.Value(apiKeyCtx{}).(string)
+	cards, _, err := fetchAllCards(apiKey)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	perms, _ := ctx.Value(permissionsKey{}).(permissions)
+	resp := &extendpb.ListCardsResponse{}
+	for _, c := range cards {
+		if perms.allowsCard(c.Id) {
+			resp.Cards = append(resp.Cards, &extendpb.Card{Id: c.Id, Last4: c.Last4, Balance: c.Balance, Name: c.Name, Status: c.Status})
+		}
+	}
+	return resp, nil
+}
+
+func (grpcServer) ListTransactions(ctx context.Context, req *extendpb.ListTransactionsRequest) (*extendpb.ListTransactionsResponse, error) {
+	if err := grpcCardAccess(ctx, req.CardId); err != nil {
+		return nil, err
+	}
+	tok, err := grpcSession(ctx, req.CardId)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := fetchTransactions(tok, req.CardId)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	resp := &extendpb.ListTransactionsResponse{}
+	for _, t := range txs {
+		resp.Transactions = append(resp.Transactions, pbTx(t))
+	}
+	return resp, nil
+}
+
+func (grpcServer) GetTransaction(ctx context.Context, req *extendpb.GetTransactionRequest) (*extendpb.Transaction, error) {
+	if err := grpcCardAccess(ctx, req.CardId); err != nil {
+		return nil, err
+	}
+	tok, err := grpcSession(ctx, req.CardId)
+	if err != nil {
+		return nil, err
+	}
+	g, err := fetchTransaction(tok, req.TransactionId)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err := grpcCardAccess(ctx, g.StringOrEmpty("virtualCardId")); err != nil {
+		return nil, err
+	}
+	raw, _ := g.MarshalJSON()
+	return &extendpb.Transaction{
+		Id:           g.StringOrEmpty("id"),
+		CardId:       g.StringOrEmpty("virtualCardId"),
+		MerchantName: g.StringOrEmpty("merchantName"),
+		Amount:       g.FloatOrZero("authBillingAmountCents") * 0.01,
+		Currency:     g.StringOrEmpty("authBillingCurrency"),
+		Status:       g.StringOrEmpty("status"),
+		AuthedAt:     g.StringOrEmpty("authedAt"),
+		UpdatedAt:    g.StringOrEmpty("updatedAt"),
+		RawJson:      string(raw),
+	}, nil
+}
+
+func (grpcServer) WatchTransactions(req *extendpb.WatchTransactionsRequest, stream extendpb.ExtendAPI_WatchTransactionsServer) error {
+	ctx := stream.Context()
+	if err := grpcCardAccess(ctx, req.CardId); err != nil {
+		return err
+	}
+	apiKey, _ := ctx.Value(apiKeyCtx{}).(string)
+	events, cancel, err := subscribe(req.CardId, apiKey)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "card '%s' is not found", req.CardId)
+	}
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			kind := extendpb.TransactionEvent_NEW
+			if e.Kind == txUpdated {
+				kind = extendpb.TransactionEvent_UPDATED
+			}
+			if err := stream.Send(&extendpb.TransactionEvent{Kind: kind, CardId: e.Card, Transaction: pbTx(e.Tx), PreviousStatus: e.Previous}); err != nil {
+				return err
+			}
+		}
+	}
+}
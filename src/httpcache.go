@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cacheTTLs = flag.String("cache-ttl",
+	"/cards=30s,/cards/{card}/transactions=15s,/cards/{card}/transactions/{transaction}=60s",
+	"response cache TTL per route, a route without TTL is not cached")
+var cacheEntries = flag.Int("cache-entries", 10000, "max cached responses, the least recently used ones are dropped first")
+
+var routeVar = regexp.MustCompile(`\{([a-z]+):[^}]*\}`)
+
+// routeName returns the path template of the matched route without variable patterns and trailing slash
+func routeName(req *http.Request) string {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return req.URL.Path
+	}
+	tmpl, _ := route.GetPathTemplate()
+	tmpl = routeVar.ReplaceAllString(tmpl, "{$1}")
+	if len(tmpl) > 1 {
+		tmpl = strings.TrimSuffix(tmpl, "/")
+	}
+	return tmpl
+}
+
+func parseTTLs(s string) (map[string]time.Duration, error) {
+	retval := make(map[string]time.Duration)
+	for _, p := range splitList(s) {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("'%s' should be route=duration", p)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		retval[strings.TrimSpace(kv[0])] = d
+	}
+	return retval, nil
+}
+
+type cachedResponse struct {
+	key     string
+	apiKey  string
+	route   string
+	card    string
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+	used    *list.Element // in responses.lru
+}
+
+var responses = struct {
+	sync.Mutex
+	ttl map[string]time.Duration
+	m   map[string]*cachedResponse
+	lru *list.List // most recently used first
+}{m: make(map[string]*cachedResponse), lru: list.New()}
+
+// storeResponse caches r, dropping the least recently used responses over -cache-entries; responses is locked
+func storeResponse(r *cachedResponse) {
+	if old, ok := responses.m[r.key]; ok {
+		dropResponse(old)
+	}
+	r.used = responses.lru.PushFront(r)
+	responses.m[r.key] = r
+	for responses.lru.Len() > *cacheEntries {
+		dropResponse(responses.lru.Back().Value.(*cachedResponse))
+	}
+}
+
+// dropResponse removes r from the cache; responses is locked
+func dropResponse(r *cachedResponse) {
+	delete(responses.m, r.key)
+	responses.lru.Remove(r.used)
+}
+
+// initResponseCache parses -cache-ttl and starts sweeping expired responses
+func initResponseCache() {
+	ttl, err := parseTTLs(*cacheTTLs)
+	if err != nil {
+		log.Fatalf("Error parsing -cache-ttl: %v", err)
+	}
+	responses.Lock()
+	responses.ttl = ttl
+	responses.Unlock()
+	go func() {
+		for range time.Tick(time.Minute) {
+			now := time.Now()
+			responses.Lock()
+			for _, r := range responses.m {
+				if now.After(r.expires) {
+					dropResponse(r)
+				}
+			}
+			responses.Unlock()
+		}
+	}()
+}
+
+// invalidateCard drops cached responses about card and every cached card list (balances may have changed)
+func invalidateCard(card string) {
+	responses.Lock()
+	defer responses.Unlock()
+	for _, r := range responses.m {
+		if r.card == card || r.route == "/cards" {
+			dropResponse(r)
+		}
+	}
+}
+
+// invalidateKey drops every cached response of apiKey
+func invalidateKey(apiKey string) {
+	responses.Lock()
+	defer responses.Unlock()
+	for _, r := range responses.m {
+		if r.apiKey == apiKey {
+			dropResponse(r)
+		}
+	}
+}
+
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified reports whether If-None-Match of req matches etag
+func notModified(req *http.Request, etag string) bool {
+	for _, tag := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedWriter) Header() http.Header         { return b.header }
+func (b *bufferedWriter) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedWriter) WriteHeader(status int)      { b.status = status }
+
+// cached serves GET responses of h per API-Key from the response cache for the TTL of the route,
+// adds strong ETag and Cache-Control headers and answers matching If-None-Match with 304
+func cached(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		apiKey, route := requestKey(req), routeName(req)
+		key := strings.Join([]string{apiKey, req.URL.RequestURI(), req.Header.Get("Accept")}, "\x00")
+		responses.Lock()
+		ttl := responses.ttl[route]
+		r, ok := responses.m[key]
+		if ok {
+			responses.lru.MoveToFront(r.used)
+		}
+		responses.Unlock()
+		if !ok || time.Now().After(r.expires) {
+			buf := &bufferedWriter{header: make(http.Header), status: http.StatusOK}
+			h(buf, req)
+			if buf.status != http.StatusOK {
+				copyHeader(w.Header(), buf.header)
+				w.WriteHeader(buf.status)
+				w.Write(buf.body.Bytes())
+				return
+			}
+			r = &cachedResponse{key: key, apiKey: apiKey, route: route, card: mux.Vars(req)["card"], header: buf.header,
+				body: buf.body.Bytes(), etag: etagOf(buf.body.Bytes()), expires: time.Now().Add(ttl)}
+			if ttl > 0 {
+				responses.Lock()
+				storeResponse(r)
+				responses.Unlock()
+			}
+		}
+		copyHeader(w.Header(), r.header)
+		w.Header().Set("ETag", r.etag)
+		if ttl > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(time.Until(r.expires).Seconds())))
+		} else {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+		if notModified(req, r.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(r.body)
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
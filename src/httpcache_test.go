@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCachedResponses(t *testing.T) {
+	responses.Lock()
+	responses.ttl = map[string]time.Duration{"/cards/{card}/transactions": time.Minute}
+	responses.Unlock()
+	calls := 0
+	rtr := mux.NewRouter()
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions", cached(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Write([]byte(`[]`))
+	}))
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cards/vc_1/transactions", nil)
+		req.Header.Set("API-Key", "key")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		rtr.ServeHTTP(rec, req)
+		return rec
+	}
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Body.String() != "[]" {
+		t.Fatalf("unexpected first response %d %v %s", first.Code, first.Header(), first.Body)
+	}
+	if second := get(etag); second.Code != http.StatusNotModified || calls != 1 {
+		t.Errorf("expected cached 304, got %d after %d calls", second.Code, calls)
+	}
+	invalidateCard("vc_1")
+	if third := get(etag); third.Code != http.StatusNotModified || calls != 2 {
+		t.Errorf("expected a fresh 304 after invalidation, got %d after %d calls", third.Code, calls)
+	}
+	if r := get(`"other"`); r.Code != http.StatusOK || r.Header().Get("Cache-Control") == "" {
+		t.Errorf("expected 200 with Cache-Control for a stale ETag, got %d %v", r.Code, r.Header())
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	defer flag.Set("cache-entries", strconv.Itoa(*cacheEntries))
+	flag.Set("cache-entries", "2")
+	responses.Lock()
+	responses.ttl = map[string]time.Duration{"/cards/{card}/transactions": time.Minute}
+	responses.Unlock()
+	calls := map[string]int{}
+	rtr := mux.NewRouter()
+	rtr.HandleFunc("/cards/{card:[A-z0-9\\-_]+}/transactions", cached(func(w http.ResponseWriter, req *http.Request) {
+		calls[req.URL.RequestURI()]++
+		w.Write([]byte(`[]`))
+	}))
+	get := func(uri string) {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.Header.Set("API-Key", "eviction-key")
+		rtr.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	defer invalidateKey("eviction-key")
+	a, b, c := "/cards/vc_1/transactions?page=a", "/cards/vc_1/transactions?page=b", "/cards/vc_1/transactions?page=c"
+	get(a)
+	get(b)
+	get(a) // a is used more recently than b
+	get(c) // over -cache-entries, b is dropped
+	get(a)
+	get(b)
+	if calls[a] != 1 || calls[b] != 2 || calls[c] != 1 {
+		t.Errorf("least recently used response should be dropped first, handler calls %v", calls)
+	}
+	responses.Lock()
+	n, used := len(responses.m), responses.lru.Len()
+	responses.Unlock()
+	if n > 2 || n != used {
+		t.Errorf("cache should hold at most -cache-entries responses, %d cached, %d in use order", n, used)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/tbolsh/extend-go-nginx-postgres-docker/jwt
+
+go 1.16
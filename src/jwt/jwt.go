@@ -0,0 +1,186 @@
+// Package jwt parses JSON Web Tokens and verifies their signatures with RSA, ECDSA or HMAC keys
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes used by RS256, ES256, HS256
+	_ "crypto/sha512" // hashes used by RS384/512, ES384/512, HS384/512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed   = errors.New("jwt: malformed token")
+	ErrAlgorithm   = errors.New("jwt: unsupported signing algorithm")
+	ErrNoKey       = errors.New("jwt: no key to verify the token")
+	ErrSignature   = errors.New("jwt: invalid signature")
+	ErrExpired     = errors.New("jwt: token has expired")
+	ErrNotYetValid = errors.New("jwt: token is not valid yet")
+)
+
+// Token is a parsed, not necessarily verified, JWT
+type Token struct {
+	Raw       string
+	Header    map[string]interface{}
+	Claims    map[string]interface{}
+	Signature []byte
+}
+
+// Parse decodes tok without verifying its signature
+func Parse(tok string) (*Token, error) {
+	parts := strings.Split(strings.TrimSpace(tok), ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	t := &Token{Raw: tok}
+	if err := decodeSegment(parts[0], &t.Header); err != nil {
+		return nil, fmt.Errorf("%w: header %v", ErrMalformed, err)
+	}
+	if err := decodeSegment(parts[1], &t.Claims); err != nil {
+		return nil, fmt.Errorf("%w: payload %v", ErrMalformed, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature %v", ErrMalformed, err)
+	}
+	t.Signature = sig
+	return t, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// signingInput is the part of the token covered by the signature
+func (t *Token) signingInput() string {
+	return t.Raw[:strings.LastIndex(t.Raw, ".")]
+}
+
+// Alg returns the "alg" header
+func (t *Token) Alg() string { return t.headerString("alg") }
+
+// Kid returns the "kid" header
+func (t *Token) Kid() string { return t.headerString("kid") }
+
+func (t *Token) headerString(name string) string {
+	s, _ := t.Header[name].(string)
+	return s
+}
+
+// String returns a string claim or empty string
+func (t *Token) String(claim string) string {
+	s, _ := t.Claims[claim].(string)
+	return s
+}
+
+// Time returns a NumericDate claim or zero time
+func (t *Token) Time(claim string) time.Time {
+	if f, ok := t.Claims[claim].(float64); ok {
+		return time.Unix(int64(f), 0)
+	}
+	return time.Time{}
+}
+
+// Audience returns the "aud" claim which may be a string or an array of strings
+func (t *Token) Audience() []string {
+	switch v := t.Claims["aud"].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		retval := make([]string, 0, len(v))
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				retval = append(retval, s)
+			}
+		}
+		return retval
+	}
+	return nil
+}
+
+// Valid checks "exp" and "nbf" claims against now
+func (t *Token) Valid(now time.Time) error { return t.ValidAt(now, 0) }
+
+// ValidAt checks "exp", "nbf" and "iat" claims against now tolerating clocks apart by up to skew
+func (t *Token) ValidAt(now time.Time, skew time.Duration) error {
+	if exp := t.Time("exp"); !exp.IsZero() && !now.Add(-skew).Before(exp) {
+		return ErrExpired
+	}
+	if nbf := t.Time("nbf"); !nbf.IsZero() && now.Add(skew).Before(nbf) {
+		return ErrNotYetValid
+	}
+	if iat := t.Time("iat"); !iat.IsZero() && now.Add(skew).Before(iat) {
+		return ErrNotYetValid
+	}
+	return nil
+}
+
+type algorithm struct {
+	hash crypto.Hash
+	kind string // RSA, EC or oct, same as JWK kty
+}
+
+var algorithms = map[string]algorithm{
+	"RS256": {crypto.SHA256, "RSA"}, "RS384": {crypto.SHA384, "RSA"}, "RS512": {crypto.SHA512, "RSA"},
+	"ES256": {crypto.SHA256, "EC"}, "ES384": {crypto.SHA384, "EC"}, "ES512": {crypto.SHA512, "EC"},
+	"HS256": {crypto.SHA256, "oct"}, "HS384": {crypto.SHA384, "oct"}, "HS512": {crypto.SHA512, "oct"},
+}
+
+// verify checks the signature of t with a single key
+func verify(t *Token, key interface{}) error {
+	alg, ok := algorithms[t.Alg()]
+	if !ok {
+		return ErrAlgorithm
+	}
+	input := []byte(t.signingInput())
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg.kind != "RSA" {
+			return ErrAlgorithm
+		}
+		h := alg.hash.New()
+		h.Write(input)
+		if rsa.VerifyPKCS1v15(k, alg.hash, h.Sum(nil), t.Signature) != nil {
+			return ErrSignature
+		}
+	case *ecdsa.PublicKey:
+		if alg.kind != "EC" {
+			return ErrAlgorithm
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(t.Signature) != 2*size {
+			return ErrSignature
+		}
+		h := alg.hash.New()
+		h.Write(input)
+		r := new(big.Int).SetBytes(t.Signature[:size])
+		s := new(big.Int).SetBytes(t.Signature[size:])
+		if !ecdsa.Verify(k, h.Sum(nil), r, s) {
+			return ErrSignature
+		}
+	case []byte:
+		if alg.kind != "oct" {
+			return ErrAlgorithm
+		}
+		m := hmac.New(alg.hash.New, k)
+		m.Write(input)
+		if !hmac.Equal(m.Sum(nil), t.Signature) {
+			return ErrSignature
+		}
+	default:
+		return ErrNoKey
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func segment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func unsigned(alg, kid string, claims map[string]interface{}) string {
+	return segment(map[string]string{"alg": alg, "typ": "JWT", "kid": kid}) + "." + segment(claims)
+}
+
+func sha(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func signed(input string, sig []byte) string {
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestParse(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	tok, err := Parse(signed(unsigned("HS256", "k1", map[string]interface{}{"sub": "user", "exp": exp, "aud": []string{"a", "b"}}), []byte("sig")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Alg() != "HS256" || tok.Kid() != "k1" || tok.String("sub") != "user" {
+		t.Errorf("unexpected token %v %v", tok.Header, tok.Claims)
+	}
+	if tok.Time("exp").Unix() != exp || len(tok.Audience()) != 2 {
+		t.Errorf("unexpected claims %v", tok.Claims)
+	}
+	if tok.Valid(time.Now()) != nil || tok.Valid(time.Now().Add(2*time.Hour)) != ErrExpired {
+		t.Errorf("unexpected validity")
+	}
+	for _, bad := range []string{"", "a.b", "a.b.c", "e30.!!.c"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("'%s' should not parse", bad)
+		}
+	}
+}
+
+func TestValidAt(t *testing.T) {
+	now := time.Now()
+	tok, err := Parse(signed(unsigned("HS256", "", map[string]interface{}{
+		"iat": now.Add(10 * time.Second).Unix(), "exp": now.Add(-10 * time.Second).Unix()}), []byte("sig")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tok.ValidAt(now, 0); err != ErrExpired {
+		t.Errorf("token should be expired without skew, got %v", err)
+	}
+	if err := tok.ValidAt(now, 30*time.Second); err != nil {
+		t.Errorf("token should be valid with 30s skew, got %v", err)
+	}
+	tok.Claims["exp"] = float64(now.Add(time.Hour).Unix())
+	if err := tok.ValidAt(now, 5*time.Second); err != ErrNotYetValid {
+		t.Errorf("token issued 10s in the future should not be valid with 5s skew, got %v", err)
+	}
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	secret := []byte("secret")
+	input := unsigned("HS256", "", map[string]interface{}{"sub": "user"})
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(input))
+	tok, _ := Parse(signed(input, m.Sum(nil)))
+	ks := NewKeys()
+	ks.Add("", secret)
+	if err := ks.Verify(tok); err != nil {
+		t.Errorf("valid HMAC signature rejected: %v", err)
+	}
+	other := NewKeys()
+	other.Add("", []byte("other"))
+	if err := other.Verify(tok); err != ErrSignature {
+		t.Errorf("expected %v, got %v", ErrSignature, err)
+	}
+}
+
+func TestVerifyRSA(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	input := unsigned("RS256", "rsa1", map[string]interface{}{"sub": "user"})
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sha(input))
+	tok, _ := Parse(signed(input, sig))
+
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":"rsa1","use":"sig","n":"%s","e":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}))
+	ks := NewKeys()
+	if err := ks.AddJWKS([]byte(jwks)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Verify(tok); err != nil {
+		t.Errorf("valid RSA signature rejected: %v", err)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	ks = NewKeys()
+	if err := ks.AddPEM(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Verify(tok); err != nil {
+		t.Errorf("valid RSA signature rejected with PEM key: %v", err)
+	}
+
+	forged, _ := Parse(signed(unsigned("RS256", "rsa1", map[string]interface{}{"sub": "admin"}), sig))
+	if err := ks.Verify(forged); err != ErrSignature {
+		t.Errorf("expected %v, got %v", ErrSignature, err)
+	}
+	none, _ := Parse(signed(unsigned("none", "rsa1", map[string]interface{}{"sub": "admin"}), nil))
+	if err := ks.Verify(none); err != ErrAlgorithm {
+		t.Errorf("expected %v, got %v", ErrAlgorithm, err)
+	}
+}
+
+func TestVerifyEC(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	input := unsigned("ES256", "ec1", map[string]interface{}{"sub": "user"})
+	r, s, _ := ecdsa.Sign(rand.Reader, key, sha(input))
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	tok, _ := Parse(signed(input, sig))
+	ks := NewKeys()
+	ks.Add("ec1", &key.PublicKey)
+	if err := ks.Verify(tok); err != nil {
+		t.Errorf("valid EC signature rejected: %v", err)
+	}
+	hs, _ := Parse(signed(unsigned("HS256", "ec1", nil), sig))
+	if err := ks.Verify(hs); err != ErrAlgorithm {
+		t.Errorf("expected %v, got %v", ErrAlgorithm, err)
+	}
+}
@@ -0,0 +1,194 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+// Keys is a set of verification keys; keys without kid are tried for any token
+type Keys struct {
+	byKid map[string]interface{}
+	other []interface{}
+}
+
+// NewKeys returns an empty key set
+func NewKeys() *Keys { return &Keys{byKid: make(map[string]interface{})} }
+
+// Len returns number of keys in the set
+func (ks *Keys) Len() int { return len(ks.byKid) + len(ks.other) }
+
+// Add a *rsa.PublicKey, *ecdsa.PublicKey or []byte (HMAC secret) with an optional kid
+func (ks *Keys) Add(kid string, key interface{}) error {
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, []byte:
+	default:
+		return fmt.Errorf("jwt: unsupported key type %T", key)
+	}
+	if kid == "" {
+		ks.other = append(ks.other, key)
+	} else {
+		ks.byKid[kid] = key
+	}
+	return nil
+}
+
+// Verify checks the signature of t with the key matching its kid or any key without kid
+func (ks *Keys) Verify(t *Token) error {
+	if key, ok := ks.byKid[t.Kid()]; ok && t.Kid() != "" {
+		return verify(t, key)
+	}
+	err := ErrNoKey
+	for _, key := range ks.other {
+		if err = verify(t, key); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// AddPEM adds every public key or certificate found in PEM encoded data
+func (ks *Keys) AddPEM(data []byte) error {
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = ks.Add("", key); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return errors.New("jwt: no public keys in PEM data")
+	}
+	return nil
+}
+
+// AddPEMFile adds keys from a PEM file
+func (ks *Keys) AddPEMFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ks.AddPEM(data)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// AddJWKS adds signing keys of a JSON Web Key Set
+func (ks *Keys) AddJWKS(data []byte) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("jwt: key '%s': %v", k.Kid, err)
+		}
+		if err = ks.Add(k.Kid, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddJWKSFile adds keys from a JWKS file
+func (ks *Keys) AddJWKSFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ks.AddJWKS(data)
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := b64int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func b64int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tbolsh/extend-go-nginx-postgres-docker/jwt"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	jwksFile    = flag.String("jwks", "", "JWKS file with IdP keys for bearer tokens")
+	jwtKeysFile = flag.String("jwt-keys", "", "PEM file with IdP public keys or certificates for bearer tokens")
+	jwtSecret   = flag.String("jwt-secret", "", "HMAC secret of bearer tokens")
+	jwtIssuer   = flag.String("jwt-iss", "", "required 'iss' claim of bearer tokens")
+	jwtAudience = flag.String("jwt-aud", "", "required 'aud' claim of bearer tokens")
+	jwtClaim    = flag.String("jwt-claim", "sub", "claim of bearer tokens matched against clients.jwt_subject")
+
+	idpKeys = jwt.NewKeys()
+)
+
+// initJWT loads IdP keys; bearer authentication stays disabled when there are none
+func initJWT() {
+	if *jwksFile != "" {
+		if err := idpKeys.AddJWKSFile(*jwksFile); err != nil {
+			log.Fatalf("Error loading JWKS file '%s': %v", *jwksFile, err)
+		}
+	}
+	if *jwtKeysFile != "" {
+		if err := idpKeys.AddPEMFile(*jwtKeysFile); err != nil {
+			log.Fatalf("Error loading PEM file '%s': %v", *jwtKeysFile, err)
+		}
+	}
+	if *extendJWKSFile != "" {
+		if err := extendKeys.AddJWKSFile(*extendJWKSFile); err != nil {
+			log.Fatalf("Error loading Extend JWKS file '%s': %v", *extendJWKSFile, err)
+		}
+	}
+	if *jwtSecret != "" {
+		idpKeys.Add("", []byte(*jwtSecret))
+	}
+	if idpKeys.Len() > 0 {
+		log.Printf("Bearer authentication enabled with %d keys", idpKeys.Len())
+	}
+}
+
+// requestKey returns the API-Key of the request: the one resolved by authorize or the API-Key header
+func requestKey(req *http.Request) string {
+	if k, ok := req.Context().Value(apiKeyCtx{}).(string); ok {
+		return k
+	}
+	return strings.TrimSpace(req.Header.Get("API-Key"))
+}
+
+type apiKeyCtx struct{}
+
+// credentials resolves the API-Key of a request either from API-Key header (or gRPC metadata)
+// or from a bearer JWT in authorization mapped to a clients row by its jwt_subject
+func credentials(apiKey, auth string) (string, error) {
+	if apiKey = strings.TrimSpace(apiKey); apiKey != "" {
+		return apiKey, nil
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", errors.New("api-Key is not specified!")
+	}
+	if idpKeys.Len() == 0 {
+		return "", errors.New("bearer authentication is not configured")
+	}
+	subject, err := bearerSubject(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		return "", err
+	}
+	data, err := persistense.Query(`SELECT api_key FROM clients WHERE jwt_subject=$1 AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > now()) ORDER BY issued_at DESC LIMIT 1`, subject)
+	if err != nil {
+		return "", fmt.Errorf("bearer subject is not found: %s", err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("bearer subject '%s' is not found", subject)
+	}
+	return data[0][0], nil
+}
+
+// bearerSubject verifies a bearer token and returns its -jwt-claim
+func bearerSubject(raw string) (string, error) {
+	tok, err := jwt.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if err = idpKeys.Verify(tok); err != nil {
+		return "", err
+	}
+	if err = tok.ValidAt(time.Now(), *clockSkew); err != nil {
+		return "", err
+	}
+	// a bearer token stands in for an API-Key, one that never expires would be a key nobody can revoke
+	if tok.Time("exp").IsZero() {
+		return "", errors.New("bearer token has no 'exp' claim")
+	}
+	if *jwtIssuer != "" && tok.String("iss") != *jwtIssuer {
+		return "", fmt.Errorf("unexpected bearer issuer '%s'", tok.String("iss"))
+	}
+	if *jwtAudience != "" && !contains(tok.Audience(), *jwtAudience) {
+		return "", fmt.Errorf("bearer token is not issued for '%s'", *jwtAudience)
+	}
+	subject := tok.String(*jwtClaim)
+	if subject == "" {
+		return "", fmt.Errorf("bearer token has no '%s' claim", *jwtClaim)
+	}
+	return subject, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/tbolsh/extend-go-nginx-postgres-docker/jwt"
+	"testing"
+	"time"
+)
+
+func TestBearerSubject(t *testing.T) {
+	defer func(keys *jwt.Keys) { idpKeys = keys }(idpKeys)
+	idpKeys = jwt.NewKeys()
+	idpKeys.Add("", []byte("bearer-test-secret"))
+	exp := time.Now().Add(time.Hour).Unix()
+	if subject, err := bearerSubject(hs256("bearer-test-secret", map[string]interface{}{"sub": "u1", "exp": exp})); err != nil || subject != "u1" {
+		t.Errorf("valid token should give its subject, got '%s' (%v)", subject, err)
+	}
+	if _, err := bearerSubject(hs256("bearer-test-secret", map[string]interface{}{"sub": "u1"})); err == nil {
+		t.Error("token without exp should be rejected")
+	}
+	if _, err := bearerSubject(hs256("other-secret", map[string]interface{}{"sub": "u1", "exp": exp})); err == nil {
+		t.Error("token signed with an unknown key should be rejected")
+	}
+}
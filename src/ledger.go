@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"strconv"
+	"time"
+)
+
+var syncInterval = flag.Duration("sync-interval", time.Hour, "how often every card of every Extend user with a valid API-Key is synced into the ledger, 0 - never")
+
+// the local ledger keeps the last seen state of every transaction of synced cards in transactions table
+// and every detected change in transaction_events table
+
+// ledgerState returns known transactions of a card by id, nil if the card was never synced
+func ledgerState(card string) (map[string]tx, error) {
+	data, err := persistense.Query(`SELECT id, amount, name, status, updated FROM transactions WHERE card=$1`, card)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]tx, len(data))
+	for _, row := range data {
+		amount, _ := strconv.ParseFloat(row[1], 64)
+		known[row[0]] = tx{Id: row[0], Amount: amount, Name: row[2], Status: row[3], Updated: row[4]}
+	}
+	return known, nil
+}
+
+// syncCard brings the ledger of card up to date with Extend, categorizes new and changed transactions
+// with rules of client and returns stored events; the first sync of a card records its transactions without events
+func syncCard(tok, card, client string) ([]txEvent, error) {
+	raw, err := fetchRawTransactions(tok, card)
+	if err != nil {
+		return nil, err
+	}
+	known, err := ledgerState(card)
+	if err != nil {
+		return nil, err
+	}
+	current := make([]tx, len(raw))
+	for i, g := range raw {
+		current[i] = txFrom(g)
+	}
+	events := diffTransactions(card, known, current)
+	if known == nil {
+		events = nil
+	}
+	detectAnomalies(card, known, current, raw)
+	var rules []rule
+	for i, t := range current {
+		if old, ok := known[t.Id]; ok && sameState(old, t) {
+			continue
+		}
+		if err := upsertTransaction(card, t, raw[i]); err != nil {
+			return nil, err
+		}
+		if rules == nil {
+			if rules, err = loadRules(client); err != nil {
+				log.Println(err)
+				rules = []rule{}
+			}
+		}
+		categorize(rules, card, t, raw[i])
+	}
+	for i := range events {
+		if events[i].ID, err = storeEvent(events[i]); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// runSync syncs every card of every Extend user with a valid API-Key once per interval, so subscriptions,
+// alerts, statements and reconciliation see cards nobody watches; changes go to subscribers of the card
+func runSync(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		keys, err := userKeys()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		synced := map[string]bool{}
+		for _, ka := range keyAccounts(keys) {
+			k, err := lookupKey(ka.Key)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			tok, err := accountSession(ka.Key, ka.Account)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			cards, err := fetchCards(tok.Token)
+			if err != nil {
+				log.Printf("sync of %s/%s: %v", keyPrefix(ka.Key), ka.Account, err)
+				continue
+			}
+			for _, c := range cards {
+				if synced[c.Id] {
+					continue
+				}
+				synced[c.Id] = true
+				events, err := syncCard(tok.Token, c.Id, k.Client)
+				if err != nil {
+					log.Printf("sync of card '%s': %v", c.Id, err)
+					continue
+				}
+				if len(events) > 0 {
+					invalidateCard(c.Id)
+					publishEvents(c.Id, events)
+				}
+			}
+		}
+	}
+}
+
+// sameState reports whether a ledger transaction is up to date with t; amounts read back from numeric(14,2)
+// are compared in cents, as floats they often differ from the amounts computed from Extend cents
+func sameState(known, t tx) bool {
+	return cents(known.Amount) == cents(t.Amount) && known.Name == t.Name && known.Status == t.Status && known.Updated == t.Updated
+}
+
+func upsertTransaction(card string, t tx, raw gjson.GenJson) error {
+	b, _ := raw.MarshalJSON()
+	return persistense.Exec(`INSERT INTO transactions(id, card, amount, name, status, updated, raw, first_seen, last_changed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now(), now())
+		ON CONFLICT (id) DO UPDATE SET amount=$3, name=$4, status=$5, updated=$6, raw=$7, last_changed=now()`,
+		t.Id, card, t.Amount, t.Name, t.Status, t.Updated, string(b))
+}
+
+func storeEvent(e txEvent) (int64, error) {
+	data, err := persistense.Query(`INSERT INTO transaction_events(at, card, tx_id, kind, amount, name, status, previous, updated)
+		VALUES (now(), $1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		e.Card, e.Tx.Id, e.Kind, e.Tx.Amount, e.Tx.Name, e.Tx.Status, e.Previous, e.Tx.Updated)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, fmt.Errorf("no id returned for event of '%s'", e.Tx.Id)
+	}
+	return strconv.ParseInt(data[0][0], 10, 64)
+}
+
+// eventsSince returns stored events of card with id greater than after
+func eventsSince(card string, after int64) ([]txEvent, error) {
+	data, err := persistense.Query(`SELECT id, tx_id, kind, amount, name, status, previous, updated
+		FROM transaction_events WHERE card=$1 AND id>$2 ORDER BY id LIMIT 1000`, card, after)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]txEvent, 0, len(data))
+	for _, row := range data {
+		id, _ := strconv.ParseInt(row[0], 10, 64)
+		amount, _ := strconv.ParseFloat(row[3], 64)
+		events = append(events, txEvent{ID: id, Kind: row[2], Card: card, Previous: row[6],
+			Tx: tx{Id: row[1], Amount: amount, Name: row[4], Status: row[5], Updated: row[7]}})
+	}
+	return events, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestSameState(t *testing.T) {
+	unequal := 0
+	for c := 1; c <= 100000; c++ {
+		fromExtend := tx{Id: "t1", Amount: float64(c) * 0.01, Name: "Uber", Status: "CLEARED", Updated: "2021-03-02T10:00:00Z"}
+		stored := fromExtend
+		// as ledgerState reads numeric(14,2) back
+		stored.Amount, _ = strconv.ParseFloat(fmt.Sprintf("%d.%02d", c/100, c%100), 64)
+		if stored != fromExtend {
+			unequal++
+		}
+		if !sameState(stored, fromExtend) {
+			t.Fatalf("%d cents read back from the ledger should be up to date", c)
+		}
+	}
+	if unequal == 0 {
+		t.Error("expected amounts that differ as floats, the case sameState exists for")
+	}
+	known := tx{Id: "t1", Amount: 12.5, Name: "Uber", Status: "PENDING"}
+	for _, changed := range []tx{
+		{Id: "t1", Amount: 12.51, Name: "Uber", Status: "PENDING"},
+		{Id: "t1", Amount: 12.5, Name: "Uber", Status: "CLEARED"},
+		{Id: "t1", Amount: 12.5, Name: "Uber", Status: "PENDING", Updated: "2021-03-02T10:00:00Z"},
+	} {
+		if sameState(known, changed) {
+			t.Errorf("%+v should differ from %+v", changed, known)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	mailBackend = flag.String("mail", "outbox", "mail delivery as name[:argument]: outbox[:dir] writes .eml files, smtp:host:port sends them")
+	mailFrom    = flag.String("mail-from", "statements@localhost", "sender of mails")
+)
+
+// attachment of a mail
+type attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// mailer delivers a mail with an HTML body
+type mailer interface {
+	Send(to []string, subject string, html []byte, attachments []attachment) error
+}
+
+// mailBackends are constructors of mailers by -mail name
+var mailBackends = map[string]func(arg string) (mailer, error){
+	"outbox": func(arg string) (mailer, error) {
+		if arg == "" {
+			arg = pathf("outbox")
+		}
+		return outbox{arg}, nil
+	},
+	"smtp": func(arg string) (mailer, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("smtp mail backend needs host:port")
+		}
+		return smtpMailer{arg}, nil
+	},
+}
+
+func newMailer() (mailer, error) {
+	parts := strings.SplitN(*mailBackend, ":", 2)
+	backend, ok := mailBackends[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown mail backend '%s'", parts[0])
+	}
+	arg := ""
+	if len(parts) > 1 {
+		arg = parts[1]
+	}
+	return backend(arg)
+}
+
+// message returns a MIME message with the html body followed by attachments
+func message(to []string, subject string, html []byte, attachments []attachment) []byte {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}})
+	part.Write(html)
+	for _, a := range attachments {
+		part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {a.ContentType},
+			"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", a.Name)}})
+		part.Write(a.Data)
+	}
+	mw.Close()
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n", *mailFrom,
+		strings.Join(to, ", "), subject, time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+// outbox is the SMTP stand-in, every mail is an .eml file in dir
+type outbox struct{ dir string }
+
+func (o outbox) Send(to []string, subject string, html []byte, attachments []attachment) error {
+	if err := os.MkdirAll(o.dir, 0750); err != nil {
+		return err
+	}
+	name, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(o.dir, time.Now().UTC().Format("20060102T150405Z")+"-"+name+".eml")
+	return os.WriteFile(file, message(to, subject, html, attachments), 0640)
+}
+
+// smtpMailer sends mails through an SMTP server without authentication, e.g. a local relay
+type smtpMailer struct{ addr string }
+
+func (s smtpMailer) Send(to []string, subject string, html []byte, attachments []attachment) error {
+	return smtp.SendMail(s.addr, nil, *mailFrom, to, message(to, subject, html, attachments))
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+type object map[string]interface{}
+
+// schemaOf describes a lite view struct as OpenAPI schema
+func schemaOf(v interface{}) object {
+	t := reflect.TypeOf(v)
+	props, required := object{}, []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, opts := f.Name, ""
+		if tag := f.Tag.Get("json"); tag != "" {
+			parts := strings.SplitN(tag, ",", 2)
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			if len(parts) > 1 {
+				opts = parts[1]
+			}
+		}
+		props[name] = typeSchema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return object{"type": "object", "properties": props, "required": required}
+}
+
+func typeSchema(t reflect.Type) object {
+	switch t.Kind() {
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.Slice:
+		return object{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		if t.PkgPath() == "time" && t.Name() == "Time" {
+			return object{"type": "string", "format": "date-time"}
+		}
+		return schemaOf(reflect.Zero(t).Interface())
+	}
+	return object{}
+}
+
+func ref(name string) object { return object{"$ref": "#/components/schemas/" + name} }
+
+func arrayOf(name string) object { return object{"type": "array", "items": ref(name)} }
+
+func jsonResponse(description string, schema object) object {
+	return object{"description": description, "content": object{"application/json": object{"schema": schema}}}
+}
+
+// renderedResponse describes a response written by render in any negotiated format
+func renderedResponse(description string, schema object) object {
+	content := object{}
+	for _, mt := range []string{"application/json", "application/x-ndjson", "text/csv", "application/msgpack"} {
+		content[mt] = object{"schema": schema}
+	}
+	return object{"description": description + "; format follows Accept or ?format=, ?envelope=true wraps json " +
+		"and msgpack as {data, meta}", "content": content}
+}
+
+var renderParams = []object{
+	{"name": "format", "in": "query", "description": "output format overriding Accept",
+		"schema": object{"type": "string", "enum": []string{formatPretty, formatJSON, formatNDJSON, formatCSV, formatMsgpack}}},
+	{"name": "envelope", "in": "query", "description": "wrap json and msgpack output as {data, meta}",
+		"schema": object{"type": "boolean"}},
+}
+
+func pathParam(name, description string) object {
+	return object{"name": name, "in": "path", "required": true, "description": description, "schema": object{"type": "string"}}
+}
+
+func queryParam(name, description, format string) object {
+	schema := object{"type": "string"}
+	if format == "integer" {
+		schema = object{"type": "integer"}
+	} else if format != "" {
+		schema["format"] = format
+	}
+	return object{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+// operation of a secured endpoint, its scope is only documented
+func operation(summary, scope string, params []object, ok object) object {
+	op := object{
+		"summary":  summary,
+		"security": []object{{"ApiKey": []string{}}, {"Bearer": []string{}}},
+		"responses": object{
+			"200": ok,
+			"401": jsonResponse("missing, unknown, expired or revoked API-Key", ref("error")),
+			"403": object{"description": "API-Key lacks the scope or access to the card"},
+		},
+	}
+	if scope != "" {
+		op["description"] = "Requires `" + scope + "` scope."
+	}
+	if content, ok := ok["content"].(object); ok && content["text/csv"] != nil {
+		params = append(append([]object{}, params...), renderParams...)
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	return op
+}
+
+var (
+	cardParam        = pathParam("card", "virtual card id")
+	transactionParam = pathParam("transaction", "transaction id")
+)
+
+var graphqlPath = func() object {
+	body := object{"required": true, "content": object{"application/json": object{"schema": object{
+		"type": "object", "required": []string{"query"}, "properties": object{
+			"query":         object{"type": "string"},
+			"operationName": object{"type": "string"},
+			"variables":     object{"type": "object"},
+		}}}}}
+	ok := jsonResponse("GraphQL response, schema is in src/graphql.go", object{"type": "object"})
+	get := operation("GraphQL query over me, cards, transactions", "", []object{
+		queryParam("query", "GraphQL query", ""),
+		queryParam("operationName", "operation to run", ""),
+		queryParam("variables", "json encoded variables", ""),
+	}, ok)
+	post := operation("GraphQL query over me, cards, transactions", "", nil, ok)
+	post["requestBody"] = body
+	return object{"get": get, "post": post}
+}()
+
+var receiptsPath = func() object {
+	binary := object{"type": "string", "format": "binary"}
+	post := operation("upload an image or pdf receipt of the transaction", scopeTransactionsWrite,
+		[]object{cardParam, transactionParam, queryParam("name", "file name of a raw body upload", "")},
+		renderedResponse("stored receipt, status is 201", ref("receipt")))
+	post["requestBody"] = object{"required": true, "content": object{
+		"multipart/form-data": object{"schema": object{"type": "object", "properties": object{"file": binary}}},
+		"image/*":             object{"schema": binary},
+		"application/pdf":     object{"schema": binary},
+	}}
+	get := operation("receipts of the transaction", scopeTransactionsRead, []object{cardParam, transactionParam},
+		renderedResponse("receipts in upload order", arrayOf("receipt")))
+	return object{"post": post, "get": get}
+}()
+
+var annotationPut = func() object {
+	put := operation("replace local annotation of the transaction", scopeTransactionsWrite,
+		[]object{cardParam, transactionParam}, renderedResponse("stored annotation", ref("annotation")))
+	put["requestBody"] = object{"required": true, "content": object{"application/json": object{"schema": ref("annotation")}}}
+	return put
+}()
+
+var rulesPath = func() object {
+	body := object{"required": true, "content": object{"application/json": object{"schema": ref("rule")}}}
+	post := operation("add a categorization rule", scopeAdmin, nil, renderedResponse("stored rule, status is 201", ref("rule")))
+	post["requestBody"] = body
+	return object{
+		"get":  operation("categorization rules in the order they fire", scopeAdmin, nil, renderedResponse("rules", arrayOf("rule"))),
+		"post": post,
+	}
+}()
+
+var rulePath = func() object {
+	ruleParam := pathParam("rule", "rule id")
+	put := operation("replace a categorization rule", scopeAdmin, []object{ruleParam}, renderedResponse("stored rule", ref("rule")))
+	put["requestBody"] = object{"required": true, "content": object{"application/json": object{"schema": ref("rule")}}}
+	return object{
+		"put":    put,
+		"delete": operation("delete a categorization rule", scopeAdmin, []object{ruleParam}, object{"description": "not used, 204 on success"}),
+	}
+}()
+
+var accountsPath = func() object {
+	post := operation("link an Extend login to the client of the API-Key, it should sign in", scopeAccountsWrite, nil,
+		renderedResponse("linked account, status is 201", ref("account")))
+	post["requestBody"] = object{"required": true, "content": object{"application/json": object{"schema": ref("accountRequest")}}}
+	return object{
+		"get":  operation("Extend accounts of the client, the primary one first", scopeAccountsRead, nil, renderedResponse("accounts", arrayOf("account"))),
+		"post": post,
+	}
+}()
+
+var statementsPath = func() object {
+	post := operation("generate the statement of a period, the last ended -statement-period by default", scopeTransactionsWrite,
+		[]object{cardParam, queryParam("from", "inclusive period start", "date-time"),
+			queryParam("to", "exclusive period end", "date-time"),
+			queryParam("mail", "mail the statement to -statement-mail-to", "boolean")},
+		renderedResponse("stored statement, status is 201", ref("statement")))
+	return object{
+		"get": operation("stored statements of a virtual card, newest first", scopeTransactionsRead, []object{cardParam},
+			renderedResponse("statements", arrayOf("statement"))),
+		"post": post,
+	}
+}()
+
+var categorizePost = func() object {
+	post := operation("apply categorization rules to synced transactions of the card", scopeTransactionsRead,
+		[]object{cardParam, queryParam("dry-run", "only report rules that would fire", "boolean")},
+		renderedResponse("rule firing for every transaction", arrayOf("ruleMatch")))
+	post["description"] = "Requires `" + scopeTransactionsRead + "` scope for a dry-run, `" + scopeTransactionsWrite + "` otherwise."
+	return post
+}()
+
+var reconciliationPath = func() object {
+	card := queryParam("card", "virtual card id", "")
+	periodParams := []object{card,
+		queryParam("from", "inclusive start of the period, -reconcile-period before 'to' by default", "date-time"),
+		queryParam("to", "exclusive end of the period, now by default", "date-time")}
+	return object{
+		"get": operation("stored reconciliation runs", scopeTransactionsRead, []object{card,
+			queryParam("differences", "only runs with differences", "boolean"),
+			queryParam("limit", "max runs, 100 by default, up to 1000", "integer")},
+			renderedResponse("newest runs first", arrayOf("reconciliation"))),
+		"post": operation("reconcile the ledger of the card, or of every synced card, with Extend", scopeTransactionsRead,
+			periodParams, renderedResponse("stored runs", arrayOf("reconciliation"))),
+	}
+}()
+
+// spec is the OpenAPI document of the routes registered by newRouter
+var spec = object{
+	"openapi": "3.0.3",
+	"info": object{
+		"title":   "Extend API service",
+		"version": "1",
+	},
+	"paths": object{
+		"/": object{"get": object{
+			"summary":   "redirects to the dashboard",
+			"responses": object{"302": object{"description": "redirect to /static/"}},
+		}},
+		"/static/{file}": object{"get": object{
+			"summary":    "embedded dashboard to browse cards and transactions, files of the static directory take precedence",
+			"parameters": []object{pathParam("file", "dashboard file, e.g. app.js; /static/ serves index.html")},
+			"responses": object{
+				"200": object{"description": "dashboard file", "content": object{"text/html": object{"schema": object{"type": "string"}}}},
+				"304": object{"description": "file did not change since its ETag"},
+				"404": object{"description": "no such dashboard file"},
+			},
+		}},
+		"/alive": object{"get": object{
+			"summary":   "liveness probe",
+			"responses": object{"200": jsonResponse("service is alive", object{"type": "object", "properties": object{"alive": object{"type": "boolean"}}})},
+		}},
+		"/version": object{"get": object{
+			"summary":   "deployed version",
+			"responses": object{"200": jsonResponse("version", object{"type": "object", "properties": object{"version": object{"type": "string"}}})},
+		}},
+		"/openapi.json": object{"get": object{
+			"summary":   "this document",
+			"responses": object{"200": jsonResponse("OpenAPI document", object{"type": "object"})},
+		}},
+		"/metrics": object{"get": operation("expvar metrics: Extend sign-ins, claims of cached Extend sessions, runtime", scopeAdmin,
+			nil, jsonResponse("expvar variables", object{"type": "object"}))},
+		"/me": object{"get": operation("signed in Extend user, session expiry and permissions of the API-Key", "", nil,
+			renderedResponse("caller", ref("meView")))},
+		"/graphql":  graphqlPath,
+		"/accounts": accountsPath,
+		"/accounts/{account}": object{"delete": operation("unlink an Extend account of the client", scopeAccountsWrite,
+			[]object{pathParam("account", "account id")}, object{"description": "not used, 204 on success"})},
+		"/audit": object{"get": operation("audit log of API access of the client, of every client with the operator scope", scopeAdmin, []object{
+			queryParam("client", "client id, other clients than the caller's need the operator scope", ""),
+			queryParam("key", "API-Key prefix", ""),
+			queryParam("card", "virtual card id", ""),
+			queryParam("transaction", "transaction id", ""),
+			queryParam("route", "route template", ""),
+			queryParam("from", "inclusive lower bound of time", "date-time"),
+			queryParam("to", "exclusive upper bound of time", "date-time"),
+			queryParam("limit", "max entries, 100 by default, up to 1000", "integer"),
+		}, renderedResponse("newest entries first", arrayOf("auditEntry")))},
+		"/retention": object{"get": operation("dry-run report of rows older than their retention", scopeAdmin, nil,
+			renderedResponse("rows that would be purged by table", arrayOf("purgeReport")))},
+		"/retention/purge": object{"post": operation("delete rows older than their retention now", scopeAdmin,
+			[]object{queryParam("dry-run", "only report rows that would be deleted", "boolean")},
+			renderedResponse("rows purged by table", arrayOf("purgeReport")))},
+		"/rules":          rulesPath,
+		"/rules/{rule}":   rulePath,
+		"/reconciliation": reconciliationPath,
+		"/reconciliation/{run}": object{"get": operation("a stored reconciliation run", scopeTransactionsRead,
+			[]object{pathParam("run", "reconciliation id")}, renderedResponse("run", ref("reconciliation")))},
+		"/alerts": object{"get": operation("anomaly alerts of new transactions of the caller's cards", scopeTransactionsRead,
+			[]object{queryParam("card", "only alerts of the virtual card", ""),
+				queryParam("kind", "only alerts with a flag of the kind, e.g. AMOUNT_OUTLIER", ""),
+				queryParam("min-score", "only alerts scoring at least this", "number"),
+				queryParam("acknowledged", "only acknowledged alerts or only not acknowledged ones", "boolean")},
+			renderedResponse("newest alerts first, up to 1000", arrayOf("alert")))},
+		"/alerts/{alert}/acknowledge": object{"post": operation("acknowledge an alert", scopeTransactionsWrite,
+			[]object{pathParam("alert", "alert id")}, renderedResponse("acknowledged alert", ref("alert")))},
+		"/subscriptions": object{"get": operation("recurring charges detected in synced transactions", scopeTransactionsRead,
+			[]object{queryParam("card", "only subscriptions of the virtual card", ""),
+				queryParam("flagged", "only missed or price-changed subscriptions", "boolean")},
+			renderedResponse("subscriptions by expected next charge", arrayOf("subscription")))},
+		"/keys/rotate": object{"post": operation("issue a new API-Key, the calling one expires after a grace period and cannot rotate again (409)", "", nil,
+			renderedResponse("new key", ref("keyView")))},
+		"/keys/{key}": object{"delete": operation("revoke the calling API-Key, or one of the same client with no scope or card the caller lacks; admin keys revoke any key of the client, 403 otherwise", "",
+			[]object{pathParam("key", "API-Key to revoke")}, object{"description": "not used, 204 on success"})},
+		"/cards": object{"get": operation("virtual cards of every Extend account of the client", scopeCardsRead, nil,
+			renderedResponse("cards the API-Key has access to, a Warning header names accounts that failed", arrayOf("card")))},
+		"/cards/{card}/transactions": object{"get": operation("transactions of a virtual card", scopeTransactionsRead,
+			[]object{cardParam, queryParam("tag", "only transactions annotated with the tag, repeat for all of several", ""),
+				queryParam("category", "only transactions annotated with the category", "")},
+			renderedResponse("pending, cleared and declined transactions", arrayOf("tx")))},
+		"/cards/{card}/transactions/{transaction}/annotations": object{"put": annotationPut},
+		"/cards/{card}/categorize":                             object{"post": categorizePost},
+		"/cards/{card}/statements":                             statementsPath,
+		"/cards/{card}/statements/{statement}": object{"get": operation("rendered statement", scopeTransactionsRead,
+			[]object{cardParam, pathParam("statement", "statement id"), queryParam("format", "html (default) or csv", "")},
+			object{"description": "statement as a HTML page or CSV", "content": object{
+				"text/html": object{"schema": object{"type": "string"}}, "text/csv": object{"schema": object{"type": "string"}}}})},
+		"/cards/{card}/transactions/stream": object{"get": operation("Server-Sent Events of new transactions and status changes",
+			scopeTransactionsRead, []object{cardParam, {"name": "Last-Event-ID", "in": "header",
+				"description": "resume after this event id", "schema": object{"type": "integer"}}},
+			object{"description": "event stream, each event is a txEvent named after its Kind",
+				"content": object{"text/event-stream": object{"schema": ref("txEvent")}}})},
+		"/cards/{card}/transactions/{transaction}/receipts": receiptsPath,
+		"/cards/{card}/transactions/{transaction}/receipts/{receipt}": object{"get": operation("download a receipt",
+			scopeTransactionsRead, []object{cardParam, transactionParam, pathParam("receipt", "receipt id")},
+			object{"description": "stored image or pdf", "content": object{
+				"image/*":         object{"schema": object{"type": "string", "format": "binary"}},
+				"application/pdf": object{"schema": object{"type": "string", "format": "binary"}}}})},
+		"/cards/{card}/transactions/{transaction}": object{"get": operation("transaction details as returned by Extend",
+			scopeTransactionsRead, []object{cardParam, transactionParam}, renderedResponse("Extend transaction", object{"type": "object"}))},
+	},
+	"components": object{
+		"schemas": object{
+			"card":           schemaOf(card{}),
+			"tx":             schemaOf(tx{}),
+			"keyView":        schemaOf(keyView{}),
+			"auditEntry":     schemaOf(auditEntry{}),
+			"txEvent":        schemaOf(txEvent{}),
+			"receipt":        schemaOf(receipt{}),
+			"annotation":     schemaOf(annotation{}),
+			"rule":           schemaOf(rule{}),
+			"ruleMatch":      schemaOf(ruleMatch{}),
+			"reconciliation": schemaOf(reconciliation{}),
+			"account":        schemaOf(account{}),
+			"subscription":   schemaOf(subscription{}),
+			"alert":          schemaOf(alert{}),
+			"statement":      schemaOf(statement{}),
+			"purgeReport":    schemaOf(purgeReport{}),
+			"accountRequest": schemaOf(accountRequest{}),
+			"error":          object{"type": "object", "properties": object{"error": object{"type": "string"}}},
+		},
+		"securitySchemes": object{
+			"ApiKey": object{"type": "apiKey", "in": "header", "name": "API-Key"},
+			"Bearer": object{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+		},
+	},
+}
+
+/*
+$ curl http://localhost:8008/openapi.json
+{"openapi": "3.0.3", ...}
+*/
+func openapi(w http.ResponseWriter, req *http.Request) {
+	retval, _ := json.MarshalIndent(spec, "  ", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(retval)
+}
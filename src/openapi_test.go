@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSpecMatchesRoutes(t *testing.T) {
+	routed := map[string]bool{}
+	err := newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		p := routeVar.ReplaceAllString(tmpl, "{$1}")
+		if len(p) > 1 {
+			p = strings.TrimSuffix(p, "/")
+		}
+		// a PathPrefix route serves every path under it, the spec names the rest of the path {file}
+		if re, err := route.GetPathRegexp(); err == nil && !strings.HasSuffix(re, "$") {
+			p += "/{file}"
+		}
+		for _, m := range methods {
+			routed[strings.ToLower(m)+" "+p] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]bool{}
+	for p, item := range spec["paths"].(object) {
+		for m := range item.(object) {
+			documented[m+" "+p] = true
+		}
+	}
+	for _, r := range keys(routed) {
+		if !documented[r] {
+			t.Errorf("route '%s' is not described in openapi.go", r)
+		}
+	}
+	for _, d := range keys(documented) {
+		if !routed[d] {
+			t.Errorf("'%s' is described in openapi.go but not routed", d)
+		}
+	}
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := schemaOf(tx{})
+	props := s["properties"].(object)
+	if len(props) != 7 || props["Amount"].(object)["type"] != "number" || props["Id"].(object)["type"] != "string" {
+		t.Errorf("unexpected tx schema %v", s)
+	}
+	if req := s["required"].([]string); len(req) != 5 || contains(req, "Annotation") || contains(req, "Alert") {
+		t.Errorf("annotation and alert of tx should be optional, required are %v", req)
+	}
+}
+
+func keys(m map[string]bool) []string {
+	retval := make([]string, 0, len(m))
+	for k := range m {
+		retval = append(retval, k)
+	}
+	sort.Strings(retval)
+	return retval
+}
@@ -7,8 +7,6 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
-	"strconv"
 	"strings"
 
 	"database/sql"
@@ -24,28 +22,9 @@ func Initialize() {
 		return
 	}
 	log.Println("persistence.Initialize")
-	// extract variables form command line and environment, env prefered (?)
+	// flags are layered over a configuration file and the environment (DBUSER, DBPASS, DBNAME, DBHOST, DBPORT)
+	// by the service configuration before Initialize
 	flag.Parse()
-	if os.Getenv("DBUSER") != "" {
-		*dbuser = os.Getenv("DBUSER")
-	}
-	if os.Getenv("DBPASS") != "" {
-		*dbpass = os.Getenv("DBPASS")
-	}
-	if os.Getenv("DBNAME") != "" {
-		*dbname = os.Getenv("DBNAME")
-	}
-	if os.Getenv("DBHOST") != "" {
-		*dbhost = os.Getenv("DBHOST")
-	}
-	if os.Getenv("DBPORT") != "" {
-		if p, err := strconv.Atoi(os.Getenv("DBPORT")); err == nil && p > 0 && p < 65536 {
-			*dbport = p
-		} else {
-			log.Printf("An error parsing DBPORT env. variable: ''%s' => '%v', '%d', Using %d",
-				os.Getenv("DBPORT"), err, p, *dbport)
-		}
-	}
 	conn := fmt.Sprintf("user=%s host=%s port=%d dbname=%s password=%s sslmode=disable", // sslmode=require 
 		*dbuser, *dbhost, *dbport, *dbname, *dbpass)
 	var err error
@@ -111,6 +90,11 @@ func AddCharColumn(table, column, def string) error {
 			table, column, table, column, def, table, column, def, table, column))
 }
 
+// EnsureColumn adds column with definition def to table unless it is already there
+func EnsureColumn(table, column, def string) error {
+	return Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;", table, column, def))
+}
+
 func DefineNewPKey(table string, column ...string) error {
 	err := Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT $s_pkey;",
 		table, table))
@@ -231,5 +215,34 @@ func BatchInsert(stmt string, arr [][]interface{}) (err error) {
 	return
 }
 
+// BatchDelete deletes rows of table matching where, at most limit rows per statement, until none is left;
+// params are those of where, it returns the number of deleted rows
+func BatchDelete(table, where string, limit int, params ...interface{}) (deleted int64, err error) {
+	if db == nil {
+		return 0, errors.New("No DB Connection")
+	}
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE ctid IN (SELECT ctid FROM %s WHERE %s LIMIT %d)", table, table, where, limit)
+	preparedStmt, err := db.Prepare(stmt)
+	if err != nil {
+		return 0, err
+	}
+	defer preparedStmt.Close()
+	for {
+		res, e := preparedStmt.Exec(params...)
+		if e != nil {
+			log.Printf("BatchDelete Error %v executing %s with %v", e, stmt, params)
+			return deleted, e
+		}
+		n, e := res.RowsAffected()
+		if e != nil {
+			return deleted, e
+		}
+		deleted += n
+		if n < int64(limit) {
+			return deleted, nil
+		}
+	}
+}
+
 // DB returns a pointer to sql.DB
 func DB() *sql.DB { return db }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	receiptMax     = flag.Int64("receipt-max", 10<<20, "max receipt size in bytes")
+	extendReceipts = flag.Bool("extend-receipts", false, "forward uploaded receipts to Extend receipt attachments")
+)
+
+var receiptTypes = map[string]bool{
+	"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true, "application/pdf": true,
+}
+
+type receipt struct {
+	Id          string
+	Transaction string
+	Card        string
+	Name        string
+	ContentType string
+	Size        int64
+	Sha256      string
+	Uploaded    time.Time
+	Extend      string `json:",omitempty"` // result of forwarding to Extend
+}
+
+const receiptColumns = `id, tx_id, card, name, content_type, size, sha256,
+	(EXTRACT(EPOCH FROM uploaded_at)*1000)::bigint, extend_status`
+
+func receiptFromRow(row []string) receipt {
+	size, _ := strconv.ParseInt(row[5], 10, 64)
+	ms, _ := strconv.ParseInt(row[7], 10, 64)
+	return receipt{Id: row[0], Transaction: row[1], Card: row[2], Name: row[3], ContentType: row[4],
+		Size: size, Sha256: row[6], Uploaded: time.Unix(0, ms*int64(time.Millisecond)).UTC(), Extend: row[8]}
+}
+
+// readReceipt returns the uploaded file of a multipart "file" field or the whole request body
+func readReceipt(w http.ResponseWriter, req *http.Request) (string, []byte, error) {
+	req.Body = http.MaxBytesReader(w, req.Body, *receiptMax+1<<20) // some room for multipart framing
+	var r io.Reader = req.Body
+	name := req.URL.Query().Get("name")
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := req.FormFile("file")
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot read 'file' field: %v", err)
+		}
+		defer file.Close()
+		r, name = file, header.Filename
+	}
+	data, err := io.ReadAll(io.LimitReader(r, *receiptMax+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if int64(len(data)) > *receiptMax {
+		return "", nil, fmt.Errorf("receipt is larger than %d bytes", *receiptMax)
+	}
+	if len(data) == 0 {
+		return "", nil, errors.New("receipt is empty")
+	}
+	return path.Base("/" + name), data, nil
+}
+
+/*
+$ curl -H "API-Key: xxx" -F file=@receipt.pdf http://localhost:8008/cards/XXX/transactions/YYY/receipts
+{"Id": "...", "ContentType": "application/pdf", ...}
+*/
+func uploadReceipt(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	tok, err := signin(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if g, err := fetchTransaction(tok, params["transaction"]); err != nil {
+		log.Println(err)
+		httpError(w, http.StatusNotFound, errors.New("transaction is not found"))
+		return
+	} else if g.StringOrEmpty("virtualCardId") != params["card"] {
+		httpError(w, http.StatusNotFound, errors.New("transaction does not belong to the card"))
+		return
+	}
+	name, data, err := readReceipt(w, req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if !receiptTypes[contentType] {
+		httpError(w, http.StatusUnsupportedMediaType, fmt.Errorf("'%s' is not an image or pdf", contentType))
+		return
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	r := receipt{Id: id, Transaction: params["transaction"], Card: params["card"], Name: name,
+		ContentType: contentType, Size: int64(len(data)), Sha256: hex.EncodeToString(sum[:]), Uploaded: time.Now().UTC()}
+	blobKey := path.Join("receipts", r.Card, r.Transaction, r.Id)
+	if _, err := blobs.Put(blobKey, bytes.NewReader(data)); err != nil {
+		log.Println(err)
+		httpError(w, http.StatusInternalServerError, errors.New("cannot store receipt"))
+		return
+	}
+	if *extendReceipts {
+		r.Extend = forwardReceipt(tok, r, data)
+	}
+	client := ""
+	if k, err := lookupKey(requestKey(req)); err == nil {
+		client = k.Client
+	}
+	err = persistense.Exec(`INSERT INTO receipts(id, tx_id, card, name, content_type, size, sha256, blob_key,
+		uploaded_at, uploaded_by, extend_status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		r.Id, r.Transaction, r.Card, r.Name, r.ContentType, r.Size, r.Sha256, blobKey, r.Uploaded, client, r.Extend)
+	if err != nil {
+		blobs.Delete(blobKey)
+		log.Println(err)
+		httpError(w, http.StatusInternalServerError, errors.New("cannot store receipt"))
+		return
+	}
+	renderStatus(w, req, http.StatusCreated, r)
+}
+
+// forwardReceipt attaches a receipt to the transaction at Extend and returns the outcome for extend_status
+func forwardReceipt(tok string, r receipt, data []byte) string {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("transactionId", r.Transaction)
+	part, _ := mw.CreateFormFile("file", r.Name)
+	part.Write(data)
+	mw.Close()
+	reqOut, _ := http.NewRequest(http.MethodPost, extendURL("/receiptattachments"), &body)
+	reqOut.Header.Add("Authorization", fmt.Sprintf("Bearer %s", tok))
+	reqOut.Header.Set("Content-Type", mw.FormDataContentType())
+	g, err := extendAPI(reqOut)
+	if err != nil {
+		log.Printf("forwarding receipt %s: %v", r.Id, err)
+		return "failed"
+	}
+	if id := g.StringOrEmpty("id"); id != "" {
+		return "attached " + id
+	}
+	return "forwarded"
+}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/cards/XXX/transactions/YYY/receipts
+[]
+*/
+func listReceipts(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	data, err := persistense.Query(`SELECT `+receiptColumns+` FROM receipts WHERE card=$1 AND tx_id=$2
+		ORDER BY uploaded_at`, params["card"], params["transaction"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	receipts := make([]receipt, 0, len(data))
+	for _, row := range data {
+		receipts = append(receipts, receiptFromRow(row))
+	}
+	render(w, req, receipts)
+}
+
+/*
+$ curl -H "API-Key: xxx" -o receipt.pdf http://localhost:8008/cards/XXX/transactions/YYY/receipts/ZZZ
+*/
+func downloadReceipt(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	data, err := persistense.Query(`SELECT `+receiptColumns+`, blob_key FROM receipts WHERE card=$1 AND tx_id=$2 AND id=$3`,
+		params["card"], params["transaction"], params["receipt"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("receipt is not found"))
+		return
+	}
+	r := receiptFromRow(data[0])
+	blob, err := blobs.Get(data[0][9])
+	if err != nil {
+		log.Println(err)
+		httpError(w, http.StatusNotFound, errors.New("receipt content is not found"))
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", r.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(r.Size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", r.Name))
+	w.Header().Set("ETag", `"`+r.Sha256+`"`)
+	if notModified(req, `"`+r.Sha256+`"`) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	io.Copy(w, blob)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	reconcileInterval = flag.Duration("reconcile-interval", 24*time.Hour, "how often synced cards are reconciled with Extend, 0 - never")
+	reconcilePeriod   = flag.Duration("reconcile-period", 30*24*time.Hour, "period reconciled by default, ending now")
+)
+
+// kinds of difference between the ledger and Extend
+const (
+	diffMissingLocal    = "MISSING_LOCAL"    // Extend has a transaction the ledger does not
+	diffMissingUpstream = "MISSING_UPSTREAM" // the ledger has a transaction Extend no longer returns
+	diffAmount          = "AMOUNT"
+	diffStatus          = "STATUS"            // the ledger is behind Extend
+	diffStatusRegressed = "STATUS_REGRESSION" // Extend moved back, e.g. CLEARED to PENDING
+	diffBalance         = "BALANCE"           // balanceCents does not match the limit less the ledger spend
+)
+
+type difference struct {
+	Kind        string
+	Transaction string `json:",omitempty"`
+	Local       string `json:",omitempty"`
+	Extend      string `json:",omitempty"`
+}
+
+// reconciliation is a stored run for a card and a period
+type reconciliation struct {
+	Id          int64
+	At          time.Time
+	Card        string
+	From        time.Time
+	To          time.Time
+	RequestedBy string
+	Synced      bool // false - the card has no ledger yet, nothing to compare
+	Checked     int
+	Differences []difference
+}
+
+// statusRank orders statuses a transaction moves through, a lower rank at Extend than in the ledger is a regression
+var statusRank = map[string]int{"PENDING": 0, "CLEARED": 1, "DECLINED": 1, "REVERSED": 2}
+
+// txTime is the authorization time of a transaction, the last update if it is unknown
+func txTime(t tx, g gjson.GenJson) (time.Time, bool) {
+	for _, s := range []string{g.StringOrEmpty("authedAt"), t.Updated} {
+		if at, err := time.Parse(time.RFC3339, s); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func inPeriod(t tx, g gjson.GenJson, from, to time.Time) bool {
+	at, ok := txTime(t, g)
+	return !ok || (!at.Before(from) && at.Before(to))
+}
+
+func cents(amount float64) int64 { return int64(math.Round(amount * 100)) }
+
+func amountString(amount float64) string { return strconv.FormatFloat(amount, 'f', 2, 64) }
+
+// diffLedger compares ledger transactions with transactions returned by Extend within [from, to)
+func diffLedger(local []tx, localRaw []gjson.GenJson, upstream []tx, upstreamRaw []gjson.GenJson,
+	from, to time.Time) (int, []difference) {
+	known := make(map[string]tx, len(local))
+	for i, t := range local {
+		if inPeriod(t, localRaw[i], from, to) {
+			known[t.Id] = t
+		}
+	}
+	checked, diffs, seen := len(known), []difference{}, make(map[string]bool, len(upstream))
+	for i, u := range upstream {
+		seen[u.Id] = true
+		l, ok := known[u.Id]
+		if !ok {
+			if inPeriod(u, upstreamRaw[i], from, to) {
+				checked++
+				diffs = append(diffs, difference{Kind: diffMissingLocal, Transaction: u.Id,
+					Extend: u.Status + " " + amountString(u.Amount)})
+			}
+			continue
+		}
+		if cents(l.Amount) != cents(u.Amount) {
+			diffs = append(diffs, difference{Kind: diffAmount, Transaction: u.Id,
+				Local: amountString(l.Amount), Extend: amountString(u.Amount)})
+		}
+		if l.Status != u.Status {
+			kind := diffStatus
+			if statusRank[u.Status] < statusRank[l.Status] {
+				kind = diffStatusRegressed
+			}
+			diffs = append(diffs, difference{Kind: kind, Transaction: u.Id, Local: l.Status, Extend: u.Status})
+		}
+	}
+	for _, t := range local {
+		if _, ok := known[t.Id]; ok && !seen[t.Id] {
+			diffs = append(diffs, difference{Kind: diffMissingUpstream, Transaction: t.Id,
+				Local: t.Status + " " + amountString(t.Amount)})
+		}
+	}
+	return checked, diffs
+}
+
+// diffBalanceOf compares balanceCents of a card with its limit less spend of pending and cleared ledger transactions;
+// recurring cards reset their spend, they are not compared
+func diffBalanceOf(cardRaw gjson.GenJson, local []tx) *difference {
+	limit, err := cardRaw.Float("limitCents")
+	if err != nil {
+		return nil
+	}
+	if recurs, _ := cardRaw.Bool("recurs"); recurs {
+		return nil
+	}
+	spent := int64(0)
+	for _, t := range local {
+		if t.Status == "PENDING" || t.Status == "CLEARED" {
+			spent += cents(t.Amount)
+		}
+	}
+	expected, balance := int64(limit)-spent, int64(cardRaw.FloatOrZero("balanceCents"))
+	if expected == balance {
+		return nil
+	}
+	return &difference{Kind: diffBalance, Local: amountString(float64(expected) * 0.01), Extend: amountString(float64(balance) * 0.01)}
+}
+
+// reconcile compares the ledger of card with Extend and stores the run
+func reconcile(tok, card string, from, to time.Time, requestedBy string) (reconciliation, error) {
+	r := reconciliation{At: time.Now().UTC(), Card: card, From: from, To: to, RequestedBy: requestedBy, Differences: []difference{}}
+	known, err := ledgerState(card)
+	if err != nil {
+		return r, err
+	}
+	if r.Synced = known != nil; r.Synced {
+		local, localRaw, err := ledgerTransactions(card)
+		if err != nil {
+			return r, err
+		}
+		upstreamRaw, err := fetchRawTransactions(tok, card)
+		if err != nil {
+			return r, err
+		}
+		upstream := make([]tx, len(upstreamRaw))
+		for i, g := range upstreamRaw {
+			upstream[i] = txFrom(g)
+		}
+		r.Checked, r.Differences = diffLedger(local, localRaw, upstream, upstreamRaw, from, to)
+		if cardRaw, err := fetchRawCard(tok, card); err != nil {
+			log.Println(err)
+		} else if d := diffBalanceOf(cardRaw, local); d != nil {
+			r.Differences = append(r.Differences, *d)
+		}
+	}
+	b, _ := json.Marshal(r.Differences)
+	data, err := persistense.Query(`INSERT INTO reconciliations(at, card, period_from, period_to, requested_by, synced,
+		checked, differences, report) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		r.At, card, from, to, requestedBy, r.Synced, r.Checked, len(r.Differences), string(b))
+	if err == nil && len(data) > 0 {
+		r.Id, _ = strconv.ParseInt(data[0][0], 10, 64)
+	}
+	return r, err
+}
+
+// reconcileUser reconciles synced cards of the Extend user signed in with tok, limited to allowed cards
+func reconcileUser(tok string, p permissions, from, to time.Time, requestedBy string) ([]reconciliation, error) {
+	cards, err := fetchCards(tok)
+	if err != nil {
+		return nil, err
+	}
+	runs := []reconciliation{}
+	for _, c := range cards {
+		if !p.allowsCard(c.Id) {
+			continue
+		}
+		if known, err := ledgerState(c.Id); err != nil || known == nil {
+			continue
+		}
+		r, err := reconcile(tok, c.Id, from, to, requestedBy)
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+// userKeys returns the newest valid API-Key of every Extend user, background jobs sign in with them
+func userKeys() ([]string, error) {
+	data, err := persistense.Query(`SELECT DISTINCT ON (email) api_key FROM clients
+		WHERE revoked_at IS NULL AND (expires_at IS NULL OR expires_at>now()) ORDER BY email, issued_at DESC`)
+	keys := make([]string, len(data))
+	for i, row := range data {
+		keys[i] = row[0]
+	}
+	return keys, err
+}
+
+// runReconciliation reconciles synced cards of every Extend user with a valid API-Key once per interval
+func runReconciliation(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		keys, err := userKeys()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		to := time.Now().UTC()
+		for _, ka := range keyAccounts(keys) {
+			tok, err := accountSession(ka.Key, ka.Account)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			runs, err := reconcileUser(tok.Token, permissions{}, to.Add(-*reconcilePeriod), to, "job")
+			if err != nil {
+				log.Println(err)
+			}
+			for _, r := range runs {
+				if len(r.Differences) > 0 {
+					log.Printf("reconciliation %d of card '%s': %d differences", r.Id, r.Card, len(r.Differences))
+				}
+			}
+		}
+	}
+}
+
+// period parses from and to query parameters, the default is -reconcile-period ending now
+func period(req *http.Request) (time.Time, time.Time, error) {
+	to, from := time.Now().UTC(), time.Time{}
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := req.URL.Query().Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return from, to, fmt.Errorf("'%s' should be RFC3339 time: %v", param, err)
+			}
+			*t = parsed
+		}
+	}
+	if from.IsZero() {
+		from = to.Add(-*reconcilePeriod)
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("'from' should be before 'to'")
+	}
+	return from, to, nil
+}
+
+/*
+$ curl -X POST -H "API-Key: xxx" "http://localhost:8008/reconciliation?card=XXX&from=2021-03-01T00:00:00Z"
+[{"Id": 1, "Card": "XXX", "Checked": 12, "Differences": [{"Kind": "AMOUNT", "Transaction": "YYY", ...}]}]
+*/
+func runReconciliationNow(w http.ResponseWriter, req *http.Request) {
+	from, to, err := period(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	p, card := permissionsFrom(req), req.URL.Query().Get("card")
+	if card != "" && !p.allowsCard(card) {
+		log.Printf("api-Key has no access to card '%s'", card)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	client := ""
+	if k, err := lookupKey(requestKey(req)); err == nil {
+		client = k.Client
+	}
+	var runs []reconciliation
+	if card != "" {
+		var t token
+		// the ledger of the card may be another client's, Extend decides whose card it is
+		if t, err = verifyCard(requestKey(req), card); err != nil {
+			log.Println(err)
+			httpError(w, http.StatusNotFound, errors.New("card is not found"))
+			return
+		}
+		var r reconciliation
+		if r, err = reconcile(t.Token, card, from, to, client); err == nil {
+			runs = []reconciliation{r}
+		}
+	} else {
+		runs = []reconciliation{}
+		for _, ka := range keyAccounts([]string{requestKey(req)}) {
+			var t token
+			if t, err = accountSession(ka.Key, ka.Account); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var accountRuns []reconciliation
+			accountRuns, err = reconcileUser(t.Token, p, from, to, client)
+			runs = append(runs, accountRuns...)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		httpError(w, http.StatusBadGateway, errors.New("reconciliation failed"))
+		return
+	}
+	render(w, req, runs)
+}
+
+const reconciliationColumns = `id, (EXTRACT(EPOCH FROM at)*1000)::bigint, card, (EXTRACT(EPOCH FROM period_from)*1000)::bigint,
+	(EXTRACT(EPOCH FROM period_to)*1000)::bigint, requested_by, synced, checked, report::text`
+
+func reconciliationFromRow(row []string) reconciliation {
+	ms := func(s string) time.Time {
+		v, _ := strconv.ParseInt(s, 10, 64)
+		return time.Unix(0, v*int64(time.Millisecond)).UTC()
+	}
+	r := reconciliation{At: ms(row[1]), Card: row[2], From: ms(row[3]), To: ms(row[4]), RequestedBy: row[5], Synced: row[6] == "true"}
+	r.Id, _ = strconv.ParseInt(row[0], 10, 64)
+	r.Checked, _ = strconv.Atoi(row[7])
+	if err := json.Unmarshal([]byte(row[8]), &r.Differences); err != nil {
+		log.Println(err)
+	}
+	return r
+}
+
+/*
+$ curl -H "API-Key: xxx" "http://localhost:8008/reconciliation?card=XXX&differences=true"
+[{"Id": 1, "Card": "XXX", ...}]
+*/
+func listReconciliations(w http.ResponseWriter, req *http.Request) {
+	q, p := req.URL.Query(), permissionsFrom(req)
+	// runs are stored by card id, only those of cards Extend shows to the caller are listed
+	cards, _, err := fetchAllCards(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ids := []string{}
+	for _, c := range cards {
+		if p.allowsCard(c.Id) {
+			ids = append(ids, c.Id)
+		}
+	}
+	where, args := "card=ANY(string_to_array($1, ','))", []interface{}{strings.Join(ids, ",")}
+	if card := q.Get("card"); card != "" {
+		if !p.allowsCard(card) {
+			log.Printf("api-Key has no access to card '%s'", card)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		where, args = where+" AND card=$2", append(args, card)
+	}
+	if ok, _ := strconv.ParseBool(q.Get("differences")); ok {
+		where += " AND differences>0"
+	}
+	limit := 100
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	data, err := persistense.Query(fmt.Sprintf(`SELECT %s FROM reconciliations WHERE %s ORDER BY at DESC LIMIT %d`,
+		reconciliationColumns, where, limit), args...)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	runs := make([]reconciliation, 0, len(data))
+	for _, row := range data {
+		runs = append(runs, reconciliationFromRow(row))
+	}
+	render(w, req, runs)
+}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/reconciliation/1
+{"Id": 1, "Card": "XXX", ...}
+*/
+func getReconciliation(w http.ResponseWriter, req *http.Request) {
+	data, err := persistense.Query(`SELECT `+reconciliationColumns+` FROM reconciliations WHERE id=$1`, mux.Vars(req)["run"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 || !permissionsFrom(req).allowsCard(data[0][2]) {
+		httpError(w, http.StatusNotFound, errors.New("reconciliation is not found"))
+		return
+	}
+	if _, err := verifyCard(requestKey(req), data[0][2]); err != nil {
+		log.Println(err)
+		httpError(w, http.StatusNotFound, errors.New("reconciliation is not found"))
+		return
+	}
+	render(w, req, reconciliationFromRow(data[0]))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func rawTxs(t *testing.T, s string) ([]tx, []gjson.GenJson) {
+	var raw []gjson.GenJson
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		t.Fatal(err)
+	}
+	txs := make([]tx, len(raw))
+	for i, g := range raw {
+		txs[i] = txFrom(g)
+	}
+	return txs, raw
+}
+
+func TestDiffLedger(t *testing.T) {
+	local, localRaw := rawTxs(t, `[
+		{"id": "same", "authBillingAmountCents": 100, "status": "CLEARED", "authedAt": "2021-03-02T00:00:00Z"},
+		{"id": "amount", "authBillingAmountCents": 100, "status": "PENDING", "authedAt": "2021-03-02T00:00:00Z"},
+		{"id": "regressed", "authBillingAmountCents": 100, "status": "CLEARED", "authedAt": "2021-03-02T00:00:00Z"},
+		{"id": "gone", "authBillingAmountCents": 100, "status": "PENDING", "authedAt": "2021-03-02T00:00:00Z"},
+		{"id": "old", "authBillingAmountCents": 100, "status": "PENDING", "authedAt": "2021-01-02T00:00:00Z"}]`)
+	upstream, upstreamRaw := rawTxs(t, `[
+		{"id": "same", "authBillingAmountCents": 100, "status": "CLEARED", "authedAt": "2021-03-02T00:00:00Z"},
+		{"id": "amount", "authBillingAmountCents": 120, "status": "CLEARED", "authedAt": "2021-03-02T00:00:00Z"},
+		{"id": "regressed", "authBillingAmountCents": 100, "status": "PENDING", "authedAt": "2021-03-02T00:00:00Z"},
+		{"id": "new", "authBillingAmountCents": 100, "status": "PENDING", "authedAt": "2021-03-03T00:00:00Z"},
+		{"id": "new-old", "authBillingAmountCents": 100, "status": "PENDING", "authedAt": "2021-01-03T00:00:00Z"}]`)
+	from, to := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	checked, diffs := diffLedger(local, localRaw, upstream, upstreamRaw, from, to)
+	if checked != 5 {
+		t.Errorf("5 transactions should be checked, checked %d", checked)
+	}
+	kinds := map[string]string{}
+	for _, d := range diffs {
+		kinds[d.Transaction+" "+d.Kind] = d.Local + "/" + d.Extend
+	}
+	expected := map[string]string{
+		"amount AMOUNT":               "1.00/1.20",
+		"amount STATUS":               "PENDING/CLEARED",
+		"regressed STATUS_REGRESSION": "CLEARED/PENDING",
+		"new MISSING_LOCAL":           "/PENDING 1.00",
+		"gone MISSING_UPSTREAM":       "PENDING 1.00/",
+	}
+	if len(kinds) != len(expected) {
+		t.Errorf("unexpected differences %v", diffs)
+	}
+	for k, v := range expected {
+		if kinds[k] != v {
+			t.Errorf("%s should be %s, is '%s'", k, v, kinds[k])
+		}
+	}
+}
+
+func TestDiffBalance(t *testing.T) {
+	local, _ := rawTxs(t, `[{"id": "a", "authBillingAmountCents": 250, "status": "CLEARED"},
+		{"id": "b", "authBillingAmountCents": 100, "status": "DECLINED"}]`)
+	var card gjson.GenJson
+	json.Unmarshal([]byte(`{"limitCents": 1000, "balanceCents": 750}`), &card)
+	if d := diffBalanceOf(card, local); d != nil {
+		t.Errorf("balance should match, found %v", d)
+	}
+	card.Set(700.0, "balanceCents")
+	if d := diffBalanceOf(card, local); d == nil || d.Local != "7.50" || d.Extend != "7.00" {
+		t.Errorf("balance should not match, found %v", d)
+	}
+	card.Set(true, "recurs")
+	if d := diffBalanceOf(card, local); d != nil {
+		t.Errorf("recurring cards are not compared, found %v", d)
+	}
+}
+
+func TestReconcileOthersCard(t *testing.T) {
+	withExtendSession(t, "k3", "c3", permissions{Scopes: []string{scopeAll}}, extendCards("k3", "vc_own"))
+	req := httptest.NewRequest(http.MethodPost, "/reconciliation?card=vc_someone_elses", nil)
+	req.Header.Set("API-Key", "k3")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("reconciling a card Extend does not show to the key should be 404, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// output formats negotiated by render
+const (
+	formatPretty  = "pretty"
+	formatJSON    = "json"
+	formatNDJSON  = "ndjson"
+	formatCSV     = "csv"
+	formatMsgpack = "msgpack"
+)
+
+var contentTypes = map[string]string{
+	formatPretty:  "application/json",
+	formatJSON:    "application/json",
+	formatNDJSON:  "application/x-ndjson",
+	formatCSV:     "text/csv; charset=utf-8",
+	formatMsgpack: "application/msgpack",
+}
+
+var mediaFormats = map[string]string{
+	"*/*":                   formatPretty,
+	"application/*":         formatPretty,
+	"application/json":      formatPretty, // compact with pretty=false parameter
+	"application/x-ndjson":  formatNDJSON,
+	"application/ndjson":    formatNDJSON,
+	"text/csv":              formatCSV,
+	"text/*":                formatCSV,
+	"application/msgpack":   formatMsgpack,
+	"application/x-msgpack": formatMsgpack,
+}
+
+var errNotAcceptable = errors.New("none of the accepted media types can be produced")
+
+// negotiate picks an output format: ?format= wins over Accept, Accept is ordered by q-values
+func negotiate(req *http.Request) (string, error) {
+	if f := req.URL.Query().Get("format"); f != "" {
+		if _, ok := contentTypes[f]; ok {
+			return f, nil
+		}
+		return "", fmt.Errorf("unknown format '%s'", f)
+	}
+	accept := req.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return formatPretty, nil
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		f, ok := mediaFormats[mt]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if f == formatPretty && params["pretty"] == "false" {
+			f = formatJSON
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	if best == "" {
+		return "", errNotAcceptable
+	}
+	return best, nil
+}
+
+// envelope wraps responses of clients asking for ?envelope=true
+type envelope struct {
+	Data interface{}            `json:"data"`
+	Meta map[string]interface{} `json:"meta"`
+}
+
+// render writes v in the format negotiated with the client
+func render(w http.ResponseWriter, req *http.Request, v interface{}) {
+	renderStatus(w, req, http.StatusOK, v)
+}
+
+// renderStatus writes v with status in the format negotiated with the client
+func renderStatus(w http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	format, err := negotiate(req)
+	if err != nil {
+		httpError(w, http.StatusNotAcceptable, err)
+		return
+	}
+	if wrap, _ := strconv.ParseBool(req.URL.Query().Get("envelope")); wrap && format != formatCSV && format != formatNDJSON {
+		meta := map[string]interface{}{"generatedAt": time.Now().UTC().Format(time.RFC3339)}
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+			meta["count"] = rv.Len()
+		}
+		v = envelope{Data: v, Meta: meta}
+	}
+	var body []byte
+	switch format {
+	case formatPretty:
+		body, err = json.MarshalIndent(v, "  ", "  ")
+	case formatJSON:
+		body, err = json.Marshal(v)
+	case formatNDJSON:
+		body, err = encodeNDJSON(v)
+	case formatCSV:
+		body, err = encodeCSV(v)
+	case formatMsgpack:
+		body, err = encodeMsgpack(v)
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	w.Header().Add("Vary", "Accept")
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	w.Write(body)
+}
+
+// generic turns v into nil, bool, float64, string, []interface{} or map[string]interface{}
+func generic(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var retval interface{}
+	return retval, json.Unmarshal(b, &retval)
+}
+
+func encodeNDJSON(v interface{}) ([]byte, error) {
+	g, err := generic(v)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := g.([]interface{})
+	if !ok {
+		items = []interface{}{g}
+	}
+	var buf bytes.Buffer
+	for _, item := range items {
+		b, _ := json.Marshal(item)
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeCSV writes a list of objects (or a single object) as rows; columns follow struct fields,
+// or sorted keys of generic objects, nested values are written as json
+func encodeCSV(v interface{}) ([]byte, error) {
+	var columns []string
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t != nil && t.Kind() == reflect.Struct {
+		columns = jsonNames(t)
+	}
+	g, err := generic(v)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := g.([]interface{})
+	if !ok {
+		items = []interface{}{g}
+	}
+	if columns == nil {
+		seen := map[string]bool{}
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				for k := range m {
+					seen[k] = true
+				}
+			}
+		}
+		for k := range seen {
+			columns = append(columns, k)
+		}
+		sort.Strings(columns)
+	}
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(columns)
+	for _, item := range items {
+		m, _ := item.(map[string]interface{})
+		row := make([]string, len(columns))
+		for i, c := range columns {
+			row[i] = csvValue(m[c])
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// jsonNames returns json names of the exported fields of struct t in declaration order
+func jsonNames(t reflect.Type) []string {
+	retval := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		retval = append(retval, name)
+	}
+	return retval
+}
+
+func csvValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// encodeMsgpack writes v as MessagePack, map keys are sorted so equal values give equal bytes
+func encodeMsgpack(v interface{}) ([]byte, error) {
+	g, err := generic(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	msgpackValue(&buf, g)
+	return buf.Bytes(), nil
+}
+
+func msgpackValue(buf *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if x {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case float64:
+		if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+			msgpackInt(buf, int64(x))
+		} else {
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, x)
+		}
+	case string:
+		msgpackHeader(buf, len(x), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		buf.WriteString(x)
+	case []interface{}:
+		msgpackHeader(buf, len(x), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range x {
+			msgpackValue(buf, item)
+		}
+	case map[string]interface{}:
+		msgpackHeader(buf, len(x), 0x80, 15, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msgpackValue(buf, k)
+			msgpackValue(buf, x[k])
+		}
+	}
+}
+
+// msgpackHeader writes a fix, 8 (if code8 is not 0), 16 or 32 bit length header
+func msgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
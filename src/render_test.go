@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                                      formatPretty,
+		"*/*":                                   formatPretty,
+		"application/json":                      formatPretty,
+		"application/json; pretty=false":        formatJSON,
+		"text/csv;q=0.5, application/msgpack":   formatMsgpack,
+		"text/html, application/x-ndjson;q=0.1": formatNDJSON,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/cards", nil)
+		req.Header.Set("Accept", accept)
+		if f, err := negotiate(req); err != nil || f != expected {
+			t.Errorf("Accept '%s': expected %s, got %s (%v)", accept, expected, f, err)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/cards?format=csv", nil)
+	req.Header.Set("Accept", "application/json")
+	if f, _ := negotiate(req); f != formatCSV {
+		t.Errorf("format parameter should win over Accept, got %s", f)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/cards", nil)
+	req.Header.Set("Accept", "image/png")
+	if _, err := negotiate(req); err != errNotAcceptable {
+		t.Errorf("expected %v, got %v", errNotAcceptable, err)
+	}
+}
+
+func TestRenderFormats(t *testing.T) {
+	cards := []card{{Id: "vc_1", Last4: "1234", Balance: 10.5, Name: "one, two", Status: "ACTIVE", Account: primaryAccount}}
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		render(rec, httptest.NewRequest(http.MethodGet, url, nil), cards)
+		return rec
+	}
+	if csv := get("/cards?format=csv").Body.String(); csv != "Id,Last4,Balance,Name,Status,Account\nvc_1,1234,10.5,\"one, two\",ACTIVE,primary\n" {
+		t.Errorf("unexpected csv %q", csv)
+	}
+	if nd := get("/cards?format=ndjson").Body.String(); nd != `{"Account":"primary","Balance":10.5,"Id":"vc_1","Last4":"1234","Name":"one, two","Status":"ACTIVE"}`+"\n" {
+		t.Errorf("unexpected ndjson %q", nd)
+	}
+	var env struct {
+		Data []card
+		Meta map[string]interface{}
+	}
+	rec := get("/cards?format=json&envelope=true")
+	if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil || len(env.Data) != 1 || env.Meta["count"] != 1.0 {
+		t.Errorf("unexpected envelope %s (%v)", rec.Body, err)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type %s", ct)
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	b, _ := encodeMsgpack(map[string]interface{}{"a": 1, "b": []interface{}{true, nil, "x", -1, 1.5, 300}})
+	expected := []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x96, 0xc3, 0xc0, 0xa1, 'x', 0xff,
+		0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xd1, 0x01, 0x2c}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("unexpected msgpack % x", b)
+	}
+}
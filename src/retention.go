@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	retention      = flag.String("retention", "audit=400d,transaction_events=90d,reconciliations=365d,alerts=180d", "comma separated table=age of rows kept, 0 - forever; ages are Go durations or days like 90d")
+	purgeInterval  = flag.Duration("purge-interval", 24*time.Hour, "how often rows older than -retention are deleted, 0 - never")
+	purgeBatchSize = flag.Int("purge-batch", 1000, "rows deleted by one statement of the purge")
+)
+
+// retentionTable tells how the age of rows of a table is known; tables not listed here, such as the ledger, rules,
+// receipts and statements with their blobs, are kept forever
+type retentionTable struct {
+	column string // timestamp of a row
+	where  string // rows that may be purged at all
+}
+
+var retentionTables = map[string]retentionTable{
+	"audit":              {"at", ""},
+	"transaction_events": {"at", ""},
+	"reconciliations":    {"at", ""},
+	"alerts":             {"at", "acknowledged_at IS NOT NULL"}, // open alerts are kept
+}
+
+// parseRetention parses -retention, ages of 0 are left out
+func parseRetention(s string) (map[string]time.Duration, error) {
+	retval := map[string]time.Duration{}
+	for _, p := range splitList(s) {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("'%s' should be table=age", p)
+		}
+		table, age := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if _, ok := retentionTables[table]; !ok {
+			return nil, fmt.Errorf("table '%s' has no retention, known are %s", table, strings.Join(retentionTableNames(), ", "))
+		}
+		var d time.Duration
+		if strings.HasSuffix(age, "d") {
+			days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", table, err)
+			}
+			d = time.Duration(days) * 24 * time.Hour
+		} else {
+			var err error
+			if d, err = time.ParseDuration(age); err != nil {
+				return nil, fmt.Errorf("%s: %v", table, err)
+			}
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("%s: age should not be negative", table)
+		}
+		if d > 0 {
+			retval[table] = d
+		}
+	}
+	return retval, nil
+}
+
+func retentionTableNames() []string {
+	names := make([]string, 0, len(retentionTables))
+	for name := range retentionTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// purgeReport is what a purge of a table removed or, for a dry run, would remove
+type purgeReport struct {
+	Table  string
+	Keep   string
+	Before time.Time // rows older than this are purged
+	Rows   int64
+	Oldest *time.Time `json:",omitempty"`
+	DryRun bool
+	Error  string `json:",omitempty"`
+}
+
+// purge deletes rows older than their retention in batches, a dry run only counts them
+func purge(now time.Time, dryRun bool) ([]purgeReport, error) {
+	policies, err := parseRetention(*retention)
+	if err != nil {
+		return nil, err
+	}
+	reports := []purgeReport{}
+	for _, table := range retentionTableNames() {
+		keep, ok := policies[table]
+		if !ok {
+			continue
+		}
+		t := retentionTables[table]
+		where := t.column + "<$1"
+		if t.where != "" {
+			where += " AND " + t.where
+		}
+		r := purgeReport{Table: table, Keep: keep.String(), Before: now.Add(-keep).UTC(), DryRun: dryRun}
+		if dryRun {
+			var data [][]string
+			if data, err = persistense.Query(`SELECT count(*), COALESCE(EXTRACT(EPOCH FROM min(`+t.column+`))::bigint, 0)
+				FROM `+table+` WHERE `+where, r.Before); err == nil && len(data) > 0 {
+				r.Rows, _ = strconv.ParseInt(data[0][0], 10, 64)
+				if oldest := unixOrZero(data[0][1]); !oldest.IsZero() {
+					oldest = oldest.UTC()
+					r.Oldest = &oldest
+				}
+			}
+		} else {
+			r.Rows, err = persistense.BatchDelete(table, where, *purgeBatchSize, r.Before)
+		}
+		if err != nil {
+			r.Error = err.Error()
+			log.Printf("purge of %s: %v", table, err)
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// runPurge deletes expired rows once per interval
+func runPurge(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		reports, err := purge(time.Now(), false)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, r := range reports {
+			if r.Rows > 0 {
+				log.Printf("purged %d rows of %s older than %s", r.Rows, r.Table, r.Before.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/retention
+[{"Table": "audit", "Keep": "9600h0m0s", "Before": "2021-02-25T12:00:00Z", "Rows": 1520, "DryRun": true, ...}]
+*/
+func retentionReport(w http.ResponseWriter, req *http.Request) {
+	reports, err := purge(time.Now(), true)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	render(w, req, reports)
+}
+
+/*
+$ curl -X POST -H "API-Key: xxx" "http://localhost:8008/retention/purge?dry-run=true"
+[{"Table": "audit", "Rows": 1520, ...}]
+*/
+func purgeNow(w http.ResponseWriter, req *http.Request) {
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry-run"))
+	reports, err := purge(time.Now(), dryRun)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	render(w, req, reports)
+}
+
+// purgeCommand purges expired rows once, -dry-run reports them
+func purgeCommand(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report rows that would be deleted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	persistense.Initialize()
+	reports, err := purge(time.Now(), *dryRun)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	verb := "DELETED"
+	if *dryRun {
+		verb = "WOULD DELETE"
+	}
+	fmt.Fprintf(tw, "TABLE\tKEEP\tBEFORE\t%s\tOLDEST\n", verb)
+	failed := 0
+	for _, r := range reports {
+		oldest := "-"
+		if r.Oldest != nil {
+			oldest = timeOrDash(*r.Oldest)
+		}
+		rows := strconv.FormatInt(r.Rows, 10)
+		if r.Error != "" {
+			failed++
+			rows += " (" + r.Error + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Table, r.Keep, timeOrDash(r.Before), rows, oldest)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("purge of %d tables failed", failed)
+	}
+	return nil
+}
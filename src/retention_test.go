@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	p, err := parseRetention("audit=400d, transaction_events=2160h, alerts=0")
+	if err != nil || len(p) != 2 || p["audit"] != 400*24*time.Hour || p["transaction_events"] != 90*24*time.Hour {
+		t.Errorf("unexpected policies %v (%v)", p, err)
+	}
+	if _, ok := p["alerts"]; ok {
+		t.Error("age 0 should keep rows forever")
+	}
+	for _, bad := range []string{"transactions=30d", "audit", "audit=-1d", "audit=soon"} {
+		if _, err := parseRetention(bad); err == nil {
+			t.Errorf("'%s' should be rejected", bad)
+		}
+	}
+	if _, err := parseRetention(*retention); err != nil {
+		t.Errorf("default -retention should be valid: %v", err)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rule assigns category, GL account and tags to transactions matching all of its conditions;
+// the first enabled rule by Priority (then Id) fires, manual annotations are never overwritten
+type rule struct {
+	Id        int64
+	Name      string
+	Priority  int      // lower fires first
+	Disabled  bool     `json:",omitempty"`
+	Merchant  string   `json:",omitempty"` // regexp of the merchant name
+	MCC       []string `json:",omitempty"` // any of merchant category codes
+	MinAmount *float64 `json:",omitempty"`
+	MaxAmount *float64 `json:",omitempty"`
+	Card      string   `json:",omitempty"`
+	Path      string   `json:",omitempty"` // dot separated path in the Extend transaction, e.g. merchantAddress.city
+	Value     string   `json:",omitempty"` // regexp of the value at Path, empty - any value
+	Category  string   `json:",omitempty"`
+	GLAccount string   `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+
+	merchant, value *regexp.Regexp
+}
+
+// compile validates r and prepares its regular expressions
+func (r *rule) compile() (err error) {
+	if r.Merchant == "" && len(r.MCC) == 0 && r.MinAmount == nil && r.MaxAmount == nil && r.Card == "" && r.Path == "" {
+		return errors.New("rule has no conditions")
+	}
+	a := annotation{Category: r.Category, GLAccount: r.GLAccount, Tags: r.Tags}
+	a.normalize()
+	if a.Category == "" && a.GLAccount == "" && len(a.Tags) == 0 {
+		return errors.New("rule assigns nothing")
+	}
+	r.Category, r.GLAccount, r.Tags = a.Category, a.GLAccount, a.Tags
+	if r.Value != "" && r.Path == "" {
+		return errors.New("rule value requires a path")
+	}
+	if r.merchant, err = optionalRegexp(r.Merchant); err != nil {
+		return fmt.Errorf("merchant: %v", err)
+	}
+	if r.value, err = optionalRegexp(r.Value); err != nil {
+		return fmt.Errorf("value: %v", err)
+	}
+	return nil
+}
+
+func optionalRegexp(s string) (*regexp.Regexp, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return regexp.Compile(s)
+}
+
+func (r *rule) matches(card string, t tx, g gjson.GenJson) bool {
+	if r.Disabled || (r.Card != "" && r.Card != card) {
+		return false
+	}
+	if r.merchant != nil && !r.merchant.MatchString(t.Name) {
+		return false
+	}
+	if len(r.MCC) > 0 {
+		if mcc, ok := valueAt(g, "mcc"); !ok || !contains(r.MCC, mcc) {
+			return false
+		}
+	}
+	if (r.MinAmount != nil && t.Amount < *r.MinAmount) || (r.MaxAmount != nil && t.Amount > *r.MaxAmount) {
+		return false
+	}
+	if r.Path != "" {
+		v, ok := valueAt(g, r.Path)
+		if !ok || (r.value != nil && !r.value.MatchString(v)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) source() string { return "rule:" + strconv.FormatInt(r.Id, 10) }
+
+// firstMatch returns the rule firing for t, rules are expected in priority order
+func firstMatch(rules []rule, card string, t tx, g gjson.GenJson) *rule {
+	for i := range rules {
+		if rules[i].matches(card, t, g) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// valueAt returns the value at dot separated path of g as a string, numeric parts index arrays
+func valueAt(g gjson.GenJson, path string) (string, bool) {
+	for _, p := range strings.Split(path, ".") {
+		var arg interface{} = p
+		if _, ok := g.Any.([]interface{}); ok {
+			i, err := strconv.Atoi(p)
+			if err != nil {
+				return "", false
+			}
+			arg = i
+		}
+		var err error
+		if g, err = g.Unwind(arg); err != nil || g.Any == nil {
+			return "", false
+		}
+	}
+	switch v := g.Any.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	}
+}
+
+const ruleColumns = `id, name, priority, disabled, merchant, mcc, COALESCE(min_amount::text, ''),
+	COALESCE(max_amount::text, ''), card, path, value, category, gl_account, tags`
+
+func ruleFromRow(row []string) (rule, error) {
+	r := rule{Name: row[1], Disabled: row[3] == "true", Merchant: row[4], MCC: splitList(row[5]), Card: row[8],
+		Path: row[9], Value: row[10], Category: row[11], GLAccount: row[12], Tags: splitList(row[13])}
+	r.Id, _ = strconv.ParseInt(row[0], 10, 64)
+	r.Priority, _ = strconv.Atoi(row[2])
+	for i, p := range []**float64{&r.MinAmount, &r.MaxAmount} {
+		if f, err := strconv.ParseFloat(row[6+i], 64); err == nil {
+			*p = &f
+		}
+	}
+	return r, r.compile()
+}
+
+// loadRules returns rules of client in the order they fire, rules that no longer compile are skipped
+func loadRules(client string) ([]rule, error) {
+	data, err := persistense.Query(`SELECT `+ruleColumns+` FROM rules WHERE client_id=$1 ORDER BY priority, id`, client)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]rule, 0, len(data))
+	for _, row := range data {
+		if r, err := ruleFromRow(row); err != nil {
+			log.Printf("rule %s is skipped: %v", row[0], err)
+		} else {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+func ruleExists(id, client string) bool {
+	data, err := persistense.Query(`SELECT id FROM rules WHERE id=$1 AND client_id=$2`, id, client)
+	return err == nil && len(data) > 0
+}
+
+// applyRule stores the annotation assigned by r unless the transaction is annotated manually,
+// returns whether it was stored
+func applyRule(card, id string, r *rule) (bool, error) {
+	data, err := persistense.Query(`INSERT INTO annotations(tx_id, card, project, gl_account, category, note, tags, updated_at, updated_by)
+		VALUES ($1, $2, '', $3, $4, '', $5, now(), $6)
+		ON CONFLICT (tx_id) DO UPDATE SET gl_account=$3, category=$4, tags=$5, updated_at=now(), updated_by=$6
+		WHERE annotations.updated_by LIKE 'rule:%' RETURNING tx_id`,
+		id, card, r.GLAccount, r.Category, strings.Join(r.Tags, ","), r.source())
+	return len(data) > 0, err
+}
+
+// clearRule drops the annotation of a transaction assigned by a rule that no longer fires
+func clearRule(id string) error {
+	return persistense.Exec(`DELETE FROM annotations WHERE tx_id=$1 AND updated_by LIKE 'rule:%'`, id)
+}
+
+// categorize applies rules of the client syncing card to a transaction seen by the sync
+func categorize(rules []rule, card string, t tx, g gjson.GenJson) {
+	if r := firstMatch(rules, card, t, g); r != nil {
+		if _, err := applyRule(card, t.Id, r); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// ruleMatch reports the rule firing for a transaction
+type ruleMatch struct {
+	Transaction string
+	Name        string
+	Amount      float64
+	Rule        int64  `json:",omitempty"` // 0 - no rule fires
+	RuleName    string `json:",omitempty"`
+	Manual      bool   `json:",omitempty"` // manual annotation wins over the rule
+	Applied     bool
+}
+
+// ledgerTransactions returns lite and raw views of transactions of card stored by syncs
+func ledgerTransactions(card string) ([]tx, []gjson.GenJson, error) {
+	data, err := persistense.Query(`SELECT id, amount, name, status, updated, COALESCE(raw::text, 'null')
+		FROM transactions WHERE card=$1 ORDER BY updated DESC, id`, card)
+	if err != nil {
+		return nil, nil, err
+	}
+	txs, raw := make([]tx, len(data)), make([]gjson.GenJson, len(data))
+	for i, row := range data {
+		amount, _ := strconv.ParseFloat(row[1], 64)
+		txs[i] = tx{Id: row[0], Amount: amount, Name: row[2], Status: row[3], Updated: row[4]}
+		if err := json.Unmarshal([]byte(row[5]), &raw[i]); err != nil {
+			log.Println(err)
+		}
+	}
+	return txs, raw, nil
+}
+
+/*
+$ curl -X POST -H "API-Key: xxx" "http://localhost:8008/cards/XXX/categorize?dry-run=true"
+[{"Transaction": "YYY", "Name": "UBER", "Amount": 12.5, "Rule": 1, "RuleName": "rides", "Applied": false}]
+*/
+func categorizeCard(w http.ResponseWriter, req *http.Request) {
+	card := mux.Vars(req)["card"]
+	dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry-run"))
+	if !dryRun && !permissionsFrom(req).allows(scopeTransactionsWrite) {
+		log.Printf("api-Key has no '%s' scope", scopeTransactionsWrite)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// the ledger of a card may have been synced by another client, Extend decides whose card it is
+	t, err := verifyCard(requestKey(req), card)
+	if err != nil {
+		log.Println(err)
+		httpError(w, http.StatusNotFound, errors.New("card is not found"))
+		return
+	}
+	client := ""
+	if k, err := lookupKey(requestKey(req)); err == nil {
+		client = k.Client
+	}
+	if known, err := ledgerState(card); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if known == nil {
+		if _, err := syncCard(t.Token, card, client); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	report, err := categorizeLedger(card, client, dryRun)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !dryRun {
+		invalidateCard(card)
+	}
+	render(w, req, report)
+}
+
+// categorizeLedger reports rules of client firing for synced transactions of card and, unless dryRun,
+// applies them; annotations of rules that no longer fire are dropped
+func categorizeLedger(card, client string, dryRun bool) ([]ruleMatch, error) {
+	txs, raw, err := ledgerTransactions(card)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := loadRules(client)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := cardAnnotations(card)
+	if err != nil {
+		return nil, err
+	}
+	report := make([]ruleMatch, len(txs))
+	for i, t := range txs {
+		report[i] = ruleMatch{Transaction: t.Id, Name: t.Name, Amount: t.Amount}
+		a := annotations[t.Id]
+		manual := a != nil && !strings.HasPrefix(a.source, "rule:")
+		r := firstMatch(rules, card, t, raw[i])
+		if r != nil {
+			report[i].Rule, report[i].RuleName, report[i].Manual = r.Id, r.Name, manual
+		}
+		switch {
+		case dryRun || manual:
+		case r != nil:
+			report[i].Applied, err = applyRule(card, t.Id, r)
+		case a != nil:
+			err = clearRule(t.Id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/rules
+[{"Id": 1, "Name": "rides", "Priority": 10, "Merchant": "(?i)uber|lyft", "Category": "Travel"}]
+*/
+func listRules(w http.ResponseWriter, req *http.Request) {
+	k, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if rules, err := loadRules(k.Client); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		render(w, req, rules)
+	}
+}
+
+func decodeRule(w http.ResponseWriter, req *http.Request) (rule, bool) {
+	var r rule
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&r); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("cannot decode rule: %v", err))
+		return r, false
+	}
+	if err := r.compile(); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return r, false
+	}
+	return r, true
+}
+
+func ruleArgs(r rule) []interface{} {
+	return []interface{}{r.Name, r.Priority, r.Disabled, r.Merchant, strings.Join(r.MCC, ","), r.MinAmount, r.MaxAmount,
+		r.Card, r.Path, r.Value, r.Category, r.GLAccount, strings.Join(r.Tags, ",")}
+}
+
+/*
+	$ curl -X POST -H "API-Key: xxx" -d '{"Name": "rides", "Priority": 10, "Merchant": "(?i)uber|lyft", "Category": "Travel"}' \
+		http://localhost:8008/rules
+
+{"Id": 1, ...}
+*/
+func createRule(w http.ResponseWriter, req *http.Request) {
+	k, err := lookupKey(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r, ok := decodeRule(w, req)
+	if !ok {
+		return
+	}
+	data, err := persistense.Query(`INSERT INTO rules(name, priority, disabled, merchant, mcc, min_amount, max_amount,
+		card, path, value, category, gl_account, tags, updated_at, client_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, now(), $14) RETURNING id`,
+		append(ruleArgs(r), k.Client)...)
+	if err != nil || len(data) == 0 {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.Id, _ = strconv.ParseInt(data[0][0], 10, 64)
+	renderStatus(w, req, http.StatusCreated, r)
+}
+
+/*
+	$ curl -X PUT -H "API-Key: xxx" -d '{"Name": "rides", "Priority": 5, "Merchant": "(?i)uber|lyft|taxi", "Category": "Travel"}' \
+		http://localhost:8008/rules/1
+
+{"Id": 1, ...}
+*/
+func updateRule(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["rule"]
+	k, err := lookupKey(requestKey(req))
+	if err != nil || !ruleExists(id, k.Client) {
+		httpError(w, http.StatusNotFound, errors.New("rule is not found"))
+		return
+	}
+	r, ok := decodeRule(w, req)
+	if !ok {
+		return
+	}
+	r.Id, _ = strconv.ParseInt(id, 10, 64)
+	if err := persistense.Exec(`UPDATE rules SET name=$2, priority=$3, disabled=$4, merchant=$5, mcc=$6, min_amount=$7,
+		max_amount=$8, card=$9, path=$10, value=$11, category=$12, gl_account=$13, tags=$14, updated_at=now()
+		WHERE id=$1 AND client_id=$15`, append(append([]interface{}{r.Id}, ruleArgs(r)...), k.Client)...); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	render(w, req, r)
+}
+
+/*
+$ curl -X DELETE -H "API-Key: xxx" http://localhost:8008/rules/1
+*/
+func deleteRule(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["rule"]
+	k, err := lookupKey(requestKey(req))
+	if err != nil || !ruleExists(id, k.Client) {
+		httpError(w, http.StatusNotFound, errors.New("rule is not found"))
+		return
+	}
+	if err := persistense.Exec(`DELETE FROM rules WHERE id=$1 AND client_id=$2`, id, k.Client); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
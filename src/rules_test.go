@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	"testing"
+)
+
+const ruleTx = `{"id": "t1", "merchantName": "UBER *TRIP", "mcc": "4121",
+	"merchantAddress": {"city": "Seattle"}, "items": [{"sku": 42}]}`
+
+func TestRuleMatches(t *testing.T) {
+	var g gjson.GenJson
+	if err := json.Unmarshal([]byte(ruleTx), &g); err != nil {
+		t.Fatal(err)
+	}
+	tr := txFrom(g)
+	tr.Amount = 25
+	min, max := 10.0, 20.0
+	rules := []rule{
+		{Id: 1, Merchant: "(?i)lyft", Category: "Travel"},
+		{Id: 2, Merchant: "UBER", MaxAmount: &max, Category: "Travel"},
+		{Id: 3, MCC: []string{"4111", "4121"}, MinAmount: &min, Path: "merchantAddress.city", Value: "^Seattle$", Category: "Travel"},
+		{Id: 4, Path: "items.0.sku", Value: "42", Tags: []string{"sku"}},
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			t.Fatalf("rule %d: %v", rules[i].Id, err)
+		}
+	}
+	if r := firstMatch(rules, "c1", tr, g); r == nil || r.Id != 3 {
+		t.Errorf("rule 3 should fire, fired %v", r)
+	}
+	rules[2].Card = "c2"
+	if r := firstMatch(rules, "c1", tr, g); r == nil || r.Id != 4 {
+		t.Errorf("rule 4 should fire, fired %v", r)
+	}
+	rules[3].Disabled = true
+	if r := firstMatch(rules, "c1", tr, g); r != nil {
+		t.Errorf("no rule should fire, fired %v", r)
+	}
+}
+
+func TestRuleCompile(t *testing.T) {
+	for _, r := range []rule{
+		{Category: "Travel"},
+		{Merchant: "uber"},
+		{Merchant: "(", Category: "Travel"},
+		{Value: "x", Category: "Travel"},
+	} {
+		if err := r.compile(); err == nil {
+			t.Errorf("rule %+v should not compile", r)
+		}
+	}
+}
+
+func TestValueAt(t *testing.T) {
+	var g gjson.GenJson
+	json.Unmarshal([]byte(ruleTx), &g)
+	for path, want := range map[string]string{"mcc": "4121", "merchantAddress.city": "Seattle", "items.0.sku": "42",
+		"merchantAddress": `{"city":"Seattle"}`} {
+		if v, ok := valueAt(g, path); !ok || v != want {
+			t.Errorf("value at %s is '%s', expected '%s'", path, v, want)
+		}
+	}
+	for _, path := range []string{"missing", "items.x", "items.1.sku", "mcc.code"} {
+		if v, ok := valueAt(g, path); ok {
+			t.Errorf("%s should not exist, found '%s'", path, v)
+		}
+	}
+}
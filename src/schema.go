@@ -0,0 +1,102 @@
+package main
+
+import (
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+)
+
+// clientsTable has a row per API-Key, see rotatedColumns when adding columns
+const clientsTable = `create table clients(api_key varchar(64), email varchar(256), password varchar(256),
+	scopes varchar(256) NOT NULL DEFAULT '*', cards varchar(2048) NOT NULL DEFAULT '',
+	client_id varchar(64) NOT NULL DEFAULT '', issued_at timestamptz NOT NULL DEFAULT now(),
+	expires_at timestamptz, revoked_at timestamptz, last_used_at timestamptz,
+	jwt_subject varchar(256) NOT NULL DEFAULT '', tokens_flushed_at timestamptz,
+	replaced_by varchar(64) NOT NULL DEFAULT '', PRIMARY KEY(api_key));`
+
+// migrate creates missing tables and columns, it is safe to run it on every start
+func migrate() {
+	sqlerr(persistense.CreateTable("clients", []string{clientsTable}))
+	sqlerr(persistense.EnsureColumn("clients", "scopes", "varchar(256) NOT NULL DEFAULT '*'"))
+	sqlerr(persistense.EnsureColumn("clients", "cards", "varchar(2048) NOT NULL DEFAULT ''"))
+	sqlerr(persistense.EnsureColumn("clients", "client_id", "varchar(64) NOT NULL DEFAULT ''"))
+	sqlerr(persistense.EnsureColumn("clients", "issued_at", "timestamptz NOT NULL DEFAULT now()"))
+	sqlerr(persistense.EnsureColumn("clients", "expires_at", "timestamptz"))
+	sqlerr(persistense.EnsureColumn("clients", "revoked_at", "timestamptz"))
+	sqlerr(persistense.EnsureColumn("clients", "last_used_at", "timestamptz"))
+	sqlerr(persistense.EnsureColumn("clients", "jwt_subject", "varchar(256) NOT NULL DEFAULT ''"))
+	sqlerr(persistense.EnsureColumn("clients", "tokens_flushed_at", "timestamptz"))
+	sqlerr(persistense.EnsureColumn("clients", "replaced_by", "varchar(64) NOT NULL DEFAULT ''"))
+	sqlerr(persistense.Exec("CREATE INDEX IF NOT EXISTS clients_client_id ON clients(client_id);"))
+	sqlerr(persistense.Exec("CREATE INDEX IF NOT EXISTS clients_jwt_subject ON clients(jwt_subject);"))
+	sqlerr(persistense.CreateTable("audit", []string{
+		`create table audit(id bigserial, at timestamptz NOT NULL, key_prefix varchar(8) NOT NULL,
+			client_id varchar(64) NOT NULL, method varchar(8) NOT NULL, route varchar(256) NOT NULL,
+			card varchar(64) NOT NULL, transaction varchar(64) NOT NULL, status int NOT NULL,
+			latency_ms int NOT NULL, client_ip varchar(64) NOT NULL, PRIMARY KEY(id));`,
+		`create index audit_at on audit(at);`,
+		`create index audit_card on audit(card, at);`,
+		// append-only: updates are ignored, rows are only ever inserted or purged
+		`create rule audit_no_update as on update to audit do instead nothing;`,
+	}))
+	sqlerr(persistense.CreateTable("transactions", []string{
+		`create table transactions(id varchar(64), card varchar(64) NOT NULL, amount numeric(14,2) NOT NULL,
+			name varchar(256) NOT NULL, status varchar(16) NOT NULL, updated varchar(64) NOT NULL, raw jsonb,
+			first_seen timestamptz NOT NULL, last_changed timestamptz NOT NULL, PRIMARY KEY(id));`,
+		`create index transactions_card on transactions(card);`,
+	}))
+	sqlerr(persistense.CreateTable("transaction_events", []string{
+		`create table transaction_events(id bigserial, at timestamptz NOT NULL, card varchar(64) NOT NULL,
+			tx_id varchar(64) NOT NULL, kind varchar(16) NOT NULL, amount numeric(14,2) NOT NULL,
+			name varchar(256) NOT NULL, status varchar(16) NOT NULL, previous varchar(16) NOT NULL,
+			updated varchar(64) NOT NULL, PRIMARY KEY(id));`,
+		`create index transaction_events_card on transaction_events(card, id);`,
+	}))
+	sqlerr(persistense.CreateTable("receipts", []string{
+		`create table receipts(id varchar(32), tx_id varchar(64) NOT NULL, card varchar(64) NOT NULL,
+			name varchar(256) NOT NULL, content_type varchar(64) NOT NULL, size bigint NOT NULL,
+			sha256 varchar(64) NOT NULL, blob_key varchar(512) NOT NULL, uploaded_at timestamptz NOT NULL,
+			uploaded_by varchar(64) NOT NULL, extend_status varchar(128) NOT NULL, PRIMARY KEY(id));`,
+		`create index receipts_tx on receipts(card, tx_id);`,
+	}))
+	sqlerr(persistense.CreateTable("annotations", []string{
+		`create table annotations(tx_id varchar(64), card varchar(64) NOT NULL, project varchar(64) NOT NULL,
+			gl_account varchar(64) NOT NULL, category varchar(64) NOT NULL, note text NOT NULL,
+			tags varchar(1024) NOT NULL, updated_at timestamptz NOT NULL, updated_by varchar(64) NOT NULL,
+			PRIMARY KEY(tx_id));`,
+		`create index annotations_card on annotations(card);`,
+	}))
+	sqlerr(persistense.CreateTable("rules", []string{
+		`create table rules(id bigserial, name varchar(128) NOT NULL, priority int NOT NULL, disabled boolean NOT NULL,
+			merchant varchar(512) NOT NULL, mcc varchar(256) NOT NULL, min_amount numeric(14,2), max_amount numeric(14,2),
+			card varchar(64) NOT NULL, path varchar(256) NOT NULL, value varchar(512) NOT NULL, category varchar(64) NOT NULL,
+			gl_account varchar(64) NOT NULL, tags varchar(1024) NOT NULL, updated_at timestamptz NOT NULL, PRIMARY KEY(id));`,
+	}))
+	sqlerr(persistense.EnsureColumn("rules", "client_id", "varchar(64) NOT NULL DEFAULT ''"))
+	sqlerr(persistense.CreateTable("reconciliations", []string{
+		`create table reconciliations(id bigserial, at timestamptz NOT NULL, card varchar(64) NOT NULL,
+			period_from timestamptz NOT NULL, period_to timestamptz NOT NULL, requested_by varchar(64) NOT NULL,
+			synced boolean NOT NULL, checked int NOT NULL, differences int NOT NULL, report jsonb NOT NULL, PRIMARY KEY(id));`,
+		`create index reconciliations_card on reconciliations(card, at);`,
+	}))
+	sqlerr(persistense.CreateTable("extend_accounts", []string{
+		`create table extend_accounts(id varchar(32) NOT NULL, client_id varchar(64) NOT NULL, label varchar(128) NOT NULL,
+			email varchar(256) NOT NULL, password varchar(256) NOT NULL, linked_at timestamptz NOT NULL, PRIMARY KEY(id));`,
+		`create index extend_accounts_client on extend_accounts(client_id);`,
+	}))
+	sqlerr(persistense.CreateTable("alerts", []string{
+		`create table alerts(id bigserial, card varchar(64) NOT NULL, tx_id varchar(64) NOT NULL, at timestamptz NOT NULL,
+			score numeric(10,2) NOT NULL, flags jsonb NOT NULL, acknowledged_at timestamptz,
+			acknowledged_by varchar(64) NOT NULL DEFAULT '', PRIMARY KEY(id), UNIQUE(tx_id));`,
+		`create index alerts_card on alerts(card, at);`,
+	}))
+	sqlerr(persistense.CreateTable("statements", []string{
+		`create table statements(id bigserial, card varchar(64) NOT NULL, period_from timestamptz NOT NULL,
+			period_to timestamptz NOT NULL, generated_at timestamptz NOT NULL, opening numeric(14,2) NOT NULL,
+			closing numeric(14,2) NOT NULL, charges numeric(14,2) NOT NULL, credits numeric(14,2) NOT NULL, count int NOT NULL,
+			categories jsonb NOT NULL, blob_key varchar(256) NOT NULL, delivered_to varchar(1024) NOT NULL,
+			PRIMARY KEY(id), UNIQUE(card, period_from, period_to));`,
+	}))
+	// rows of these tables are purged by age, see retention.go
+	sqlerr(persistense.Exec("CREATE INDEX IF NOT EXISTS transaction_events_at ON transaction_events(at);"))
+	sqlerr(persistense.Exec("CREATE INDEX IF NOT EXISTS reconciliations_at ON reconciliations(at);"))
+	sqlerr(persistense.Exec("CREATE INDEX IF NOT EXISTS alerts_at ON alerts(at);"))
+}
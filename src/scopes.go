@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// scopes an API-Key may be granted, stored comma separated in clients.scopes
+const (
+	scopeAll               = "*" // every scope but admin and operator
+	scopeAdmin             = "admin"
+	scopeOperator          = "operator" // sees data of every client, e.g. the whole audit log
+	scopeCardsRead         = "cards:read"
+	scopeCardsWrite        = "cards:write"
+	scopeTransactionsRead  = "transactions:read"
+	scopeTransactionsWrite = "transactions:write"
+	scopeAccountsRead      = "accounts:read"
+	scopeAccountsWrite     = "accounts:write"
+)
+
+// permissions of a single API-Key; empty Cards means every card of the Extend user
+type permissions struct {
+	Scopes []string
+	Cards  []string
+}
+
+func parsePermissions(scopes, cards string) permissions {
+	return permissions{Scopes: splitList(scopes), Cards: splitList(cards)}
+}
+
+func splitList(s string) []string {
+	retval := make([]string, 0)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			retval = append(retval, p)
+		}
+	}
+	return retval
+}
+
+func (p permissions) allows(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || (s == scopeAll && scope != scopeAdmin && scope != scopeOperator) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p permissions) restricted() bool { return len(p.Cards) > 0 }
+
+func (p permissions) allowsCard(id string) bool {
+	if !p.restricted() {
+		return true
+	}
+	for _, c := range p.Cards {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+type permissionsKey struct{}
+
+// permissionsFrom returns permissions stored in the request context by authorize
+func permissionsFrom(req *http.Request) permissions {
+	if p, ok := req.Context().Value(permissionsKey{}).(permissions); ok {
+		return p
+	}
+	return permissions{}
+}
+
+// authenticate resolves a valid, not expired or revoked, key from API-Key or Authorization header values
+func authenticate(apiKeyHeader, authorization string) (string, clientKey, error) {
+	apiKey, err := credentials(apiKeyHeader, authorization)
+	var k clientKey
+	if err == nil {
+		k, err = lookupKey(apiKey)
+	}
+	if err == nil {
+		err = k.check(time.Now())
+	}
+	if err == nil {
+		touch(apiKey)
+	}
+	return apiKey, k, err
+}
+
+// authorize rejects requests with a missing, expired or revoked API-Key (or bearer token), or a key that lacks
+// scope (empty scope - any valid key) or access to the {card} route variable
+func authorize(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		apiKey, k, err := authenticate(req.Header.Get("API-Key"), req.Header.Get("Authorization"))
+		if err != nil {
+			log.Println(err)
+			httpError(w, http.StatusUnauthorized, err)
+			return
+		}
+		setAuditKey(req, k)
+		p := k.permissions
+		if scope != "" && !p.allows(scope) {
+			log.Printf("api-Key has no '%s' scope", scope)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if card, ok := mux.Vars(req)["card"]; ok && !p.allowsCard(card) {
+			log.Printf("api-Key has no access to card '%s'", card)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(req.Context(), permissionsKey{}, p)
+		h(w, req.WithContext(context.WithValue(ctx, apiKeyCtx{}, apiKey)))
+	}
+}
+
+// ownedCard answers 404 unless Extend shows the card of the route to the caller, see verifyCard; it wraps
+// handlers serving data stored by card id, inside authorize
+func ownedCard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if _, err := verifyCard(requestKey(req), mux.Vars(req)["card"]); err != nil {
+			log.Println(err)
+			httpError(w, http.StatusNotFound, errors.New("card is not found"))
+			return
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	p := parsePermissions(" cards:read, transactions:read ,", "")
+	if len(p.Scopes) != 2 {
+		t.Errorf("expected 2 scopes, got %v", p.Scopes)
+	}
+	if !p.allows(scopeCardsRead) || !p.allows(scopeTransactionsRead) || p.allows(scopeCardsWrite) {
+		t.Errorf("unexpected scopes check result for %v", p.Scopes)
+	}
+	if p.restricted() || !p.allowsCard("any") {
+		t.Errorf("permissions without cards should allow every card")
+	}
+	all := parsePermissions("*", "vc_1,vc_2")
+	if !all.allows(scopeCardsWrite) || all.allows(scopeAdmin) {
+		t.Errorf("'*' should allow every scope but admin")
+	}
+	if !all.allowsCard("vc_2") || all.allowsCard("vc_3") {
+		t.Errorf("unexpected card check result for %v", all.Cards)
+	}
+	if parsePermissions("", "").allows(scopeCardsRead) {
+		t.Errorf("empty scopes should allow nothing")
+	}
+}
+
+// TestAccountScopes checks the scopes account routes require, handlers that pass them need a database
+func TestAccountScopes(t *testing.T) {
+	withExtendSession(t, "k4", "c4", parsePermissions(scopeAccountsRead, ""), extendCards("k4"))
+	if p := parsePermissions(scopeAll, ""); !p.allows(scopeAccountsWrite) {
+		t.Error("'*' should allow managing accounts")
+	}
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodPost, "/accounts", http.StatusForbidden},
+		{http.MethodDelete, "/accounts/3f2a9c0d1e4b5a6f", http.StatusForbidden},
+		{http.MethodGet, "/audit", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("API-Key", "k4")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s %s with accounts:read should be answered %d, got %d %s", c.method, c.path, c.status, rec.Code, rec.Body)
+		}
+	}
+}
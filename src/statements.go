@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	persistense "github.com/tbolsh/extend-go-nginx-postgres-docker/persistense"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	statementPeriod   = flag.String("statement-period", "monthly", "period of card statements: weekly, monthly or quarterly")
+	statementInterval = flag.Duration("statement-interval", time.Hour, "how often statements of ended periods are generated, 0 - never")
+	statementMailTo   = flag.String("statement-mail-to", "", "comma separated recipients of generated statements, empty - not mailed")
+)
+
+// statementPeriods return the last period of their kind ended by now, in UTC
+var statementPeriods = map[string]func(now time.Time) (time.Time, time.Time){
+	"weekly": func(now time.Time) (time.Time, time.Time) {
+		now = now.UTC()
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		to := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)) // Monday
+		return to.AddDate(0, 0, -7), to
+	},
+	"monthly": func(now time.Time) (time.Time, time.Time) {
+		now = now.UTC()
+		to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return to.AddDate(0, -1, 0), to
+	},
+	"quarterly": func(now time.Time) (time.Time, time.Time) {
+		now = now.UTC()
+		to := time.Date(now.Year(), now.Month()-(now.Month()-1)%3, 1, 0, 0, 0, 0, time.UTC)
+		return to.AddDate(0, -3, 0), to
+	},
+}
+
+// statement of a card for the period [From, To); balances are the card's net spend recorded in the ledger
+type statement struct {
+	Id             int64
+	Card           string
+	From           time.Time
+	To             time.Time
+	Generated      time.Time
+	OpeningBalance float64
+	ClosingBalance float64
+	Charges        float64
+	Credits        float64 // refunds, negative
+	Count          int
+	Categories     map[string]float64 // net spend by annotation category
+	DeliveredTo    string             `json:",omitempty"`
+	Lines          []statementLine    `json:"-"`
+}
+
+type statementLine struct {
+	Date        time.Time
+	Transaction string
+	Merchant    string
+	Status      string
+	Category    string
+	Amount      float64
+}
+
+const uncategorized = "Uncategorized"
+
+// counted reports whether a transaction moves the balance
+func counted(status string) bool { return status != "DECLINED" && status != "REVERSED" }
+
+// buildStatement sums the ledger of card for [from, to) with categories of annotations
+func buildStatement(card string, txs []tx, raw []gjson.GenJson, annotations map[string]*annotation, from, to time.Time) statement {
+	s := statement{Card: card, From: from, To: to, Categories: map[string]float64{}, Lines: []statementLine{}}
+	for i, t := range txs {
+		at, ok := txTime(t, raw[i])
+		if !ok || !at.Before(to) {
+			continue
+		}
+		if at.Before(from) {
+			if counted(t.Status) {
+				s.OpeningBalance += t.Amount
+			}
+			continue
+		}
+		category := uncategorized
+		if a := annotations[t.Id]; a != nil && a.Category != "" {
+			category = a.Category
+		}
+		s.Lines = append(s.Lines, statementLine{Date: at.UTC(), Transaction: t.Id, Merchant: t.Name, Status: t.Status,
+			Category: category, Amount: t.Amount})
+		if !counted(t.Status) {
+			continue
+		}
+		s.Count++
+		if t.Amount < 0 {
+			s.Credits += t.Amount
+		} else {
+			s.Charges += t.Amount
+		}
+		s.Categories[category] += t.Amount
+	}
+	sort.Slice(s.Lines, func(i, j int) bool { return s.Lines[i].Date.Before(s.Lines[j].Date) })
+	round := func(v float64) float64 { return float64(cents(v)) / 100 }
+	s.OpeningBalance, s.Charges, s.Credits = round(s.OpeningBalance), round(s.Charges), round(s.Credits)
+	s.ClosingBalance = round(s.OpeningBalance + s.Charges + s.Credits)
+	for c, v := range s.Categories {
+		s.Categories[c] = round(v)
+	}
+	return s
+}
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"amount": amountString,
+	"date":   func(t time.Time) string { return t.Format("2006-01-02") },
+	"categories": func(m map[string]float64) []string {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Statement of {{.Card}} {{date .From}} - {{date .To}}</title></head>
+<body>
+<h1>Statement of card {{.Card}}</h1>
+<p>{{date .From}} - {{date .To}} (exclusive), generated {{.Generated.Format "2006-01-02 15:04 MST"}}</p>
+<table>
+<tr><th>Opening balance</th><td>{{amount .OpeningBalance}}</td></tr>
+<tr><th>Charges</th><td>{{amount .Charges}}</td></tr>
+<tr><th>Credits</th><td>{{amount .Credits}}</td></tr>
+<tr><th>Closing balance</th><td>{{amount .ClosingBalance}}</td></tr>
+</table>
+<h2>By category</h2>
+<table>
+{{range $c := categories .Categories}}<tr><th>{{$c}}</th><td>{{amount (index $.Categories $c)}}</td></tr>
+{{end}}</table>
+<h2>Transactions</h2>
+<table>
+<tr><th>Date</th><th>Merchant</th><th>Category</th><th>Status</th><th>Amount</th></tr>
+{{range .Lines}}<tr><td>{{date .Date}}</td><td>{{.Merchant}}</td><td>{{.Category}}</td><td>{{.Status}}</td><td>{{amount .Amount}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+func statementHTML(s statement) ([]byte, error) {
+	var buf bytes.Buffer
+	err := statementTemplate.Execute(&buf, s)
+	return buf.Bytes(), err
+}
+
+// statementCSV writes the transactions followed by totals by category and balances
+func statementCSV(s statement) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"Date", "Transaction", "Merchant", "Category", "Status", "Amount"})
+	for _, l := range s.Lines {
+		cw.Write([]string{l.Date.Format("2006-01-02"), l.Transaction, l.Merchant, l.Category, l.Status, amountString(l.Amount)})
+	}
+	cw.Write(nil)
+	categories := make([]string, 0, len(s.Categories))
+	for c := range s.Categories {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+	for _, c := range categories {
+		cw.Write([]string{"", "", "Category total", c, "", amountString(s.Categories[c])})
+	}
+	totals := []struct {
+		name   string
+		amount float64
+	}{{"Opening balance", s.OpeningBalance}, {"Charges", s.Charges}, {"Credits", s.Credits}, {"Closing balance", s.ClosingBalance}}
+	for _, t := range totals {
+		cw.Write([]string{"", "", t.name, "", "", amountString(t.amount)})
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// generateStatement builds, renders and stores the statement of card for [from, to) replacing an earlier one
+func generateStatement(card string, from, to time.Time) (statement, error) {
+	txs, raw, err := ledgerTransactions(card)
+	if err != nil {
+		return statement{}, err
+	}
+	annotations, err := cardAnnotations(card)
+	if err != nil {
+		log.Println(err)
+	}
+	s := buildStatement(card, txs, raw, annotations, from, to)
+	s.Generated = time.Now().UTC()
+	html, err := statementHTML(s)
+	if err != nil {
+		return s, err
+	}
+	csvData, err := statementCSV(s)
+	if err != nil {
+		return s, err
+	}
+	key := fmt.Sprintf("statements/%s/%s_%s", card, from.Format("20060102"), to.Format("20060102"))
+	if _, err := blobs.Put(key+".html", bytes.NewReader(html)); err != nil {
+		return s, err
+	}
+	if _, err := blobs.Put(key+".csv", bytes.NewReader(csvData)); err != nil {
+		return s, err
+	}
+	categories, _ := json.Marshal(s.Categories)
+	data, err := persistense.Query(`INSERT INTO statements(card, period_from, period_to, generated_at, opening, closing,
+		charges, credits, count, categories, blob_key, delivered_to) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, '')
+		ON CONFLICT (card, period_from, period_to) DO UPDATE SET generated_at=$4, opening=$5, closing=$6, charges=$7,
+		credits=$8, count=$9, categories=$10, blob_key=$11 RETURNING id`,
+		card, from, to, s.Generated, s.OpeningBalance, s.ClosingBalance, s.Charges, s.Credits, s.Count, string(categories), key)
+	if err != nil || len(data) == 0 {
+		return s, fmt.Errorf("cannot store statement of '%s': %v", card, err)
+	}
+	s.Id, _ = strconv.ParseInt(data[0][0], 10, 64)
+	return s, nil
+}
+
+// deliverStatement mails the statement to recipients and records them
+func deliverStatement(s statement, recipients []string) (statement, error) {
+	if len(recipients) == 0 {
+		return s, nil
+	}
+	m, err := newMailer()
+	if err != nil {
+		return s, err
+	}
+	html, err := statementHTML(s)
+	if err != nil {
+		return s, err
+	}
+	csvData, err := statementCSV(s)
+	if err != nil {
+		return s, err
+	}
+	name := fmt.Sprintf("statement-%s-%s", s.Card, s.From.Format("2006-01-02"))
+	if err := m.Send(recipients, fmt.Sprintf("Statement of card %s, %s - %s", s.Card, s.From.Format("2006-01-02"),
+		s.To.Format("2006-01-02")), html, []attachment{{name + ".csv", "text/csv", csvData}}); err != nil {
+		return s, err
+	}
+	s.DeliveredTo = strings.Join(recipients, ",")
+	return s, persistense.Exec(`UPDATE statements SET delivered_to=$2 WHERE id=$1`, s.Id, s.DeliveredTo)
+}
+
+// runStatements generates and mails statements of the last ended -statement-period of every synced card
+// once per interval
+func runStatements(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		from, to := statementPeriods[*statementPeriod](time.Now())
+		data, err := persistense.Query(`SELECT DISTINCT t.card FROM transactions t WHERE NOT EXISTS
+			(SELECT 1 FROM statements s WHERE s.card=t.card AND s.period_from=$1 AND s.period_to=$2)`, from, to)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, row := range data {
+			s, err := generateStatement(row[0], from, to)
+			if err == nil {
+				_, err = deliverStatement(s, splitList(*statementMailTo))
+			}
+			if err != nil {
+				log.Printf("statement of '%s': %v", row[0], err)
+			}
+		}
+	}
+}
+
+const statementColumns = `id, card, (EXTRACT(EPOCH FROM period_from)*1000)::bigint, (EXTRACT(EPOCH FROM period_to)*1000)::bigint,
+	(EXTRACT(EPOCH FROM generated_at)*1000)::bigint, opening, closing, charges, credits, count, categories::text, delivered_to`
+
+func statementFromRow(row []string) statement {
+	ms := func(s string) time.Time {
+		v, _ := strconv.ParseInt(s, 10, 64)
+		return time.Unix(0, v*int64(time.Millisecond)).UTC()
+	}
+	num := func(s string) float64 {
+		v, _ := strconv.ParseFloat(s, 64)
+		return v
+	}
+	s := statement{Card: row[1], From: ms(row[2]), To: ms(row[3]), Generated: ms(row[4]), OpeningBalance: num(row[5]),
+		ClosingBalance: num(row[6]), Charges: num(row[7]), Credits: num(row[8]), Categories: map[string]float64{},
+		DeliveredTo: row[11]}
+	s.Id, _ = strconv.ParseInt(row[0], 10, 64)
+	s.Count, _ = strconv.Atoi(row[9])
+	if err := json.Unmarshal([]byte(row[10]), &s.Categories); err != nil {
+		log.Println(err)
+	}
+	return s
+}
+
+/*
+$ curl -H "API-Key: xxx" http://localhost:8008/cards/XXX/statements
+[{"Id": 1, "Card": "XXX", "From": "2022-03-01T00:00:00Z", "To": "2022-04-01T00:00:00Z", "ClosingBalance": 812.5, ...}]
+*/
+func listStatements(w http.ResponseWriter, req *http.Request) {
+	data, err := persistense.Query(`SELECT `+statementColumns+` FROM statements WHERE card=$1 ORDER BY period_from DESC`,
+		mux.Vars(req)["card"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	statements := make([]statement, 0, len(data))
+	for _, row := range data {
+		statements = append(statements, statementFromRow(row))
+	}
+	render(w, req, statements)
+}
+
+/*
+$ curl -X POST -H "API-Key: xxx" "http://localhost:8008/cards/XXX/statements?from=2022-03-01T00:00:00Z&to=2022-04-01T00:00:00Z&mail=true"
+{"Id": 1, "Card": "XXX", ...}
+*/
+func createStatement(w http.ResponseWriter, req *http.Request) {
+	card, q := mux.Vars(req)["card"], req.URL.Query()
+	from, to := statementPeriods[*statementPeriod](time.Now())
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, fmt.Errorf("%s: %v", param, err))
+				return
+			}
+			*t = parsed.UTC()
+		}
+	}
+	if !from.Before(to) {
+		httpError(w, http.StatusBadRequest, errors.New("from should be before to"))
+		return
+	}
+	if known, err := ledgerState(card); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if known == nil {
+		httpError(w, http.StatusConflict, errors.New("the card was never synced, stream or categorize it first"))
+		return
+	}
+	s, err := generateStatement(card, from, to)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if mail, _ := strconv.ParseBool(q.Get("mail")); mail {
+		if s, err = deliverStatement(s, splitList(*statementMailTo)); err != nil {
+			log.Println(err)
+			httpError(w, http.StatusBadGateway, errors.New("statement is stored but could not be mailed"))
+			return
+		}
+	}
+	renderStatus(w, req, http.StatusCreated, s)
+}
+
+/*
+$ curl -H "API-Key: xxx" -o statement.csv "http://localhost:8008/cards/XXX/statements/1?format=csv"
+*/
+func downloadStatement(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	data, err := persistense.Query(`SELECT blob_key FROM statements WHERE card=$1 AND id=$2`, params["card"], params["statement"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		httpError(w, http.StatusNotFound, errors.New("statement is not found"))
+		return
+	}
+	ext, contentType := ".html", "text/html; charset=utf-8"
+	if req.URL.Query().Get("format") == formatCSV || strings.Contains(req.Header.Get("Accept"), "text/csv") {
+		ext, contentType = ".csv", "text/csv"
+	}
+	blob, err := blobs.Get(data[0][0] + ext)
+	if err != nil {
+		log.Println(err)
+		httpError(w, http.StatusNotFound, errors.New("statement content is not found"))
+		return
+	}
+	defer blob.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", "statement-"+params["statement"]+ext))
+	io.Copy(w, blob)
+}
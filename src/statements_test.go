@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildStatement(t *testing.T) {
+	txs, raw := rawTxs(t, `[
+		{"id": "old", "merchantName": "Uber", "authBillingAmountCents": 1000, "status": "CLEARED", "authedAt": "2021-02-20T10:00:00Z"},
+		{"id": "t1", "merchantName": "Uber", "authBillingAmountCents": 2550, "status": "CLEARED", "authedAt": "2021-03-02T10:00:00Z"},
+		{"id": "t2", "merchantName": "Hotel", "authBillingAmountCents": 10000, "status": "PENDING", "authedAt": "2021-03-05T10:00:00Z"},
+		{"id": "t3", "merchantName": "Hotel", "authBillingAmountCents": -2000, "status": "CLEARED", "authedAt": "2021-03-06T10:00:00Z"},
+		{"id": "no", "merchantName": "Shop", "authBillingAmountCents": 500, "status": "DECLINED", "authedAt": "2021-03-07T10:00:00Z"},
+		{"id": "next", "merchantName": "Uber", "authBillingAmountCents": 700, "status": "PENDING", "authedAt": "2021-04-01T00:00:00Z"}]`)
+	annotations := map[string]*annotation{"t2": {Category: "Lodging"}, "t3": {Category: "Lodging"}}
+	from, to := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	s := buildStatement("vc_1", txs, raw, annotations, from, to)
+	if s.OpeningBalance != 10 || s.Charges != 125.5 || s.Credits != -20 || s.ClosingBalance != 115.5 || s.Count != 3 {
+		t.Errorf("unexpected totals %+v", s)
+	}
+	if len(s.Categories) != 2 || s.Categories["Lodging"] != 80 || s.Categories[uncategorized] != 25.5 {
+		t.Errorf("unexpected categories %v", s.Categories)
+	}
+	if len(s.Lines) != 4 || s.Lines[0].Transaction != "t1" || s.Lines[3].Status != "DECLINED" {
+		t.Errorf("lines of the period in order expected, declined ones included: %+v", s.Lines)
+	}
+	csv, err := statementCSV(s)
+	if err != nil || !strings.Contains(string(csv), "2021-03-02,t1,Uber,Uncategorized,CLEARED,25.50\n") ||
+		!strings.HasSuffix(string(csv), ",,Closing balance,,,115.50\n") {
+		t.Errorf("unexpected csv %s (%v)", csv, err)
+	}
+	html, err := statementHTML(s)
+	if err != nil || !strings.Contains(string(html), "<td>Lodging</td>") {
+		t.Errorf("unexpected html %s (%v)", html, err)
+	}
+}
+
+func TestStatementPeriods(t *testing.T) {
+	now := time.Date(2021, 5, 13, 15, 0, 0, 0, time.UTC) // Thursday
+	day := func(m time.Month, d int) time.Time { return time.Date(2021, m, d, 0, 0, 0, 0, time.UTC) }
+	for name, expected := range map[string][2]time.Time{
+		"weekly":    {day(5, 3), day(5, 10)},
+		"monthly":   {day(4, 1), day(5, 1)},
+		"quarterly": {day(1, 1), day(4, 1)},
+	} {
+		if from, to := statementPeriods[name](now); !from.Equal(expected[0]) || !to.Equal(expected[1]) {
+			t.Errorf("%s period should be %v - %v, got %v - %v", name, expected[0], expected[1], from, to)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := (outbox{dir}).Send([]string{"a@example.com"}, "Statement", []byte("<p>hi</p>"),
+		[]attachment{{"s.csv", "text/csv", []byte("a,b\n")}}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("one mail expected, got %v", files)
+	}
+	b, _ := ioutil.ReadFile(files[0])
+	for _, part := range []string{"To: a@example.com\r\n", "Subject: Statement\r\n", "<p>hi</p>", `filename="s.csv"`} {
+		if !strings.Contains(string(b), part) {
+			t.Errorf("mail should contain %q:\n%s", part, b)
+		}
+	}
+}
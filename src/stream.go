@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const streamHeartbeat = 30 * time.Second
+
+/*
+$ curl -N -H "API-Key: xxx" -H "Last-Event-ID: 42" http://localhost:8008/cards/XXX/transactions/stream
+id: 43
+event: UPDATED
+data: {"ID":43,"Kind":"UPDATED","Card":"XXX","Tx":{...},"Previous":"PENDING"}
+*/
+func streamTransactions(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	card := mux.Vars(req)["card"]
+	// subscribe before replaying so nothing falls between the two
+	events, cancel, err := subscribe(card, requestKey(req))
+	if err != nil {
+		log.Println(err)
+		httpError(w, http.StatusNotFound, errors.New("card is not found"))
+		return
+	}
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx must not buffer the stream
+	w.WriteHeader(http.StatusOK)
+	var last int64
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		if after, err := strconv.ParseInt(id, 10, 64); err == nil {
+			replay, err := eventsSince(card, after)
+			if err != nil {
+				log.Println(err)
+			}
+			for _, e := range replay {
+				writeEvent(w, e)
+				last = e.ID
+			}
+		}
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.ID <= last {
+				continue
+			}
+			writeEvent(w, e)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e txEvent) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Kind, data)
+}
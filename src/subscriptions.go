@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	gjson "github.com/tbolsh/extend-go-nginx-postgres-docker/genericjson"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flags of a subscription
+const (
+	subscriptionMissed       = "MISSED"        // the expected charge did not come within the tolerance of its cadence
+	subscriptionPriceChanged = "PRICE_CHANGED" // the last charge differs from the one before
+)
+
+// cadence of recurring charges, intervals within tolerance days of days match it
+type cadence struct {
+	name      string
+	days      float64
+	tolerance float64
+	minCount  int // charges needed to call a merchant recurring
+	next      func(time.Time) time.Time
+}
+
+var cadences = []cadence{
+	{"WEEKLY", 7, 1, 3, func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }},
+	{"MONTHLY", 30.44, 4, 3, func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"QUARTERLY", 91.31, 7, 2, func(t time.Time) time.Time { return t.AddDate(0, 3, 0) }},
+	{"YEARLY", 365.25, 10, 2, func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// amountTolerance is the relative difference of charges still taken for the same price
+const amountTolerance = 0.2
+
+// subscription is a merchant charging a card on a regular cadence
+type subscription struct {
+	Card           string
+	Merchant       string
+	Cadence        string
+	Charges        int
+	FirstCharge    time.Time
+	LastCharge     time.Time
+	LastAmount     float64
+	PreviousAmount float64 `json:",omitempty"` // set when the price changed
+	NextCharge     time.Time
+	ExpectedAmount float64
+	Missed         int      `json:",omitempty"` // expected charges that did not come
+	Flags          []string `json:",omitempty"`
+	Transactions   []string
+}
+
+// merchantKey normalizes merchant names: descriptors often append order numbers or phone numbers,
+// tokens with digits are dropped
+func merchantKey(name string) string {
+	words := []string{}
+	for _, w := range strings.Fields(strings.ToLower(name)) {
+		if !strings.ContainsAny(w, "0123456789") {
+			words = append(words, w)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+type charge struct {
+	id     string
+	at     time.Time
+	amount float64
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	if n := len(sorted); n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[len(sorted)/2]
+}
+
+// mostly reports whether at least 3/4 of values satisfy ok
+func mostly(values []float64, ok func(float64) bool) bool {
+	n := 0
+	for _, v := range values {
+		if ok(v) {
+			n++
+		}
+	}
+	return n*4 >= len(values)*3
+}
+
+// detectSubscriptions finds merchants charging card regularly in the stored transactions txs with their raw
+// Extend views; declined, reversed and refund transactions are ignored
+func detectSubscriptions(card string, txs []tx, raw []gjson.GenJson, now time.Time) []subscription {
+	byMerchant := map[string][]charge{}
+	names := map[string]string{}
+	for i, t := range txs {
+		if t.Status == "DECLINED" || t.Status == "REVERSED" || t.Amount <= 0 {
+			continue
+		}
+		var g gjson.GenJson
+		if i < len(raw) {
+			g = raw[i]
+		}
+		at, ok := txTime(t, g)
+		key := merchantKey(t.Name)
+		if !ok || key == "" {
+			continue
+		}
+		byMerchant[key] = append(byMerchant[key], charge{t.Id, at, t.Amount})
+		names[key] = t.Name
+	}
+	retval := []subscription{}
+	for key, charges := range byMerchant {
+		if s, ok := recurring(charges, now); ok {
+			s.Card, s.Merchant = card, names[key]
+			retval = append(retval, s)
+		}
+	}
+	sort.Slice(retval, func(i, j int) bool {
+		if !retval[i].NextCharge.Equal(retval[j].NextCharge) {
+			return retval[i].NextCharge.Before(retval[j].NextCharge)
+		}
+		return retval[i].Merchant < retval[j].Merchant
+	})
+	return retval
+}
+
+// recurring checks charges of a merchant for a cadence with regular intervals and a stable price
+func recurring(charges []charge, now time.Time) (subscription, bool) {
+	var s subscription
+	if len(charges) < 2 {
+		return s, false
+	}
+	sort.Slice(charges, func(i, j int) bool { return charges[i].at.Before(charges[j].at) })
+	intervals := make([]float64, len(charges)-1)
+	for i := 1; i < len(charges); i++ {
+		intervals[i-1] = charges[i].at.Sub(charges[i-1].at).Hours() / 24
+	}
+	m := median(intervals)
+	var c *cadence
+	for i := range cadences {
+		if math.Abs(m-cadences[i].days) <= cadences[i].tolerance {
+			c = &cadences[i]
+			break
+		}
+	}
+	if c == nil || len(charges) < c.minCount ||
+		!mostly(intervals, func(d float64) bool { return math.Abs(d-c.days) <= c.tolerance }) {
+		return s, false
+	}
+	// the price of the last charge may have changed, earlier ones should agree
+	earlier := make([]float64, len(charges)-1)
+	for i := range earlier {
+		earlier[i] = charges[i].amount
+	}
+	price := median(earlier)
+	if !mostly(earlier, func(a float64) bool { return math.Abs(a-price) <= price*amountTolerance }) {
+		return s, false
+	}
+	last, previous := charges[len(charges)-1], charges[len(charges)-2]
+	s = subscription{Cadence: c.name, Charges: len(charges), FirstCharge: charges[0].at.UTC(), LastCharge: last.at.UTC(),
+		LastAmount: last.amount, ExpectedAmount: last.amount, NextCharge: c.next(last.at).UTC()}
+	if cents(last.amount) != cents(previous.amount) {
+		s.PreviousAmount = previous.amount
+		s.Flags = append(s.Flags, subscriptionPriceChanged)
+	}
+	grace := time.Duration(c.tolerance * 24 * float64(time.Hour))
+	for next := s.NextCharge; now.After(next.Add(grace)); next = c.next(next) {
+		s.Missed++
+	}
+	if s.Missed > 0 {
+		s.Flags = append(s.Flags, subscriptionMissed)
+	}
+	for _, ch := range charges {
+		s.Transactions = append(s.Transactions, ch.id)
+	}
+	return s, true
+}
+
+/*
+$ curl -H "API-Key: xxx" "http://localhost:8008/subscriptions?flagged=true"
+[{"Card": "XXX", "Merchant": "SLACK", "Cadence": "MONTHLY", "NextCharge": "2022-05-01T10:00:00Z", "Flags": ["PRICE_CHANGED"], ...}]
+*/
+func listSubscriptions(w http.ResponseWriter, req *http.Request) {
+	p, only := permissionsFrom(req), req.URL.Query().Get("card")
+	flagged, _ := strconv.ParseBool(req.URL.Query().Get("flagged"))
+	if only != "" && !p.allowsCard(only) {
+		log.Printf("api-Key has no access to card '%s'", only)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	cards, _, err := fetchAllCards(requestKey(req))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	now, retval := time.Now(), []subscription{}
+	found := false
+	for _, c := range cards {
+		if !p.allowsCard(c.Id) || (only != "" && c.Id != only) {
+			continue
+		}
+		found = true
+		txs, raw, err := ledgerTransactions(c.Id)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, s := range detectSubscriptions(c.Id, txs, raw, now) {
+			if !flagged || len(s.Flags) > 0 {
+				retval = append(retval, s)
+			}
+		}
+	}
+	if only != "" && !found {
+		httpError(w, http.StatusNotFound, errors.New("card is not found"))
+		return
+	}
+	sort.SliceStable(retval, func(i, j int) bool { return retval[i].NextCharge.Before(retval[j].NextCharge) })
+	render(w, req, retval)
+}
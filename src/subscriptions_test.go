@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectSubscriptions(t *testing.T) {
+	txs, raw := rawTxs(t, `[
+		{"id": "s1", "merchantName": "SLACK T0123", "authBillingAmountCents": 8000, "status": "CLEARED", "authedAt": "2021-01-05T10:00:00Z"},
+		{"id": "s2", "merchantName": "SLACK T0456", "authBillingAmountCents": 8000, "status": "CLEARED", "authedAt": "2021-02-05T10:00:00Z"},
+		{"id": "s3", "merchantName": "SLACK T0789", "authBillingAmountCents": 8000, "status": "CLEARED", "authedAt": "2021-03-06T10:00:00Z"},
+		{"id": "s4", "merchantName": "SLACK T0999", "authBillingAmountCents": 9600, "status": "PENDING", "authedAt": "2021-04-05T10:00:00Z"},
+		{"id": "d1", "merchantName": "Dropbox", "authBillingAmountCents": 1200, "status": "CLEARED", "authedAt": "2021-01-10T10:00:00Z"},
+		{"id": "d2", "merchantName": "Dropbox", "authBillingAmountCents": 1200, "status": "CLEARED", "authedAt": "2021-02-10T10:00:00Z"},
+		{"id": "d3", "merchantName": "Dropbox", "authBillingAmountCents": 1200, "status": "CLEARED", "authedAt": "2021-03-10T10:00:00Z"},
+		{"id": "x", "merchantName": "Dropbox", "authBillingAmountCents": 1200, "status": "DECLINED", "authedAt": "2021-04-10T10:00:00Z"},
+		{"id": "c1", "merchantName": "Coffee", "authBillingAmountCents": 450, "status": "CLEARED", "authedAt": "2021-01-02T10:00:00Z"},
+		{"id": "c2", "merchantName": "Coffee", "authBillingAmountCents": 1250, "status": "CLEARED", "authedAt": "2021-01-09T10:00:00Z"},
+		{"id": "c3", "merchantName": "Coffee", "authBillingAmountCents": 300, "status": "CLEARED", "authedAt": "2021-01-23T10:00:00Z"},
+		{"id": "c4", "merchantName": "Coffee", "authBillingAmountCents": 700, "status": "CLEARED", "authedAt": "2021-01-24T10:00:00Z"}]`)
+	now := time.Date(2021, 4, 20, 0, 0, 0, 0, time.UTC)
+	subs := detectSubscriptions("vc_1", txs, raw, now)
+	if len(subs) != 2 {
+		t.Fatalf("slack and dropbox should be detected, got %+v", subs)
+	}
+	dropbox, slack := subs[0], subs[1]
+	if dropbox.Merchant != "Dropbox" || dropbox.Cadence != "MONTHLY" || dropbox.Charges != 3 ||
+		!dropbox.NextCharge.Equal(time.Date(2021, 4, 10, 10, 0, 0, 0, time.UTC)) || dropbox.Missed != 1 ||
+		len(dropbox.Flags) != 1 || dropbox.Flags[0] != subscriptionMissed {
+		t.Errorf("dropbox should be monthly and missed, declined charges do not count: %+v", dropbox)
+	}
+	if slack.Card != "vc_1" || slack.Charges != 4 || slack.ExpectedAmount != 96 || slack.PreviousAmount != 80 ||
+		!slack.NextCharge.Equal(time.Date(2021, 5, 5, 10, 0, 0, 0, time.UTC)) ||
+		len(slack.Flags) != 1 || slack.Flags[0] != subscriptionPriceChanged {
+		t.Errorf("slack should be monthly with a changed price: %+v", slack)
+	}
+}
+
+func TestMerchantKey(t *testing.T) {
+	if k := merchantKey("  Netflix.com  866-579-7172 "); k != "netflix.com" {
+		t.Errorf("unexpected key '%s'", k)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+var watchInterval = flag.Duration("watch-interval", 15*time.Second, "how often watched cards are polled")
+
+// kinds of txEvent
+const (
+	txNew     = "NEW"
+	txUpdated = "UPDATED"
+)
+
+// txEvent is a new transaction or a status change of a known one
+type txEvent struct {
+	ID       int64 // transaction_events.id
+	Kind     string
+	Card     string
+	Tx       tx
+	Previous string `json:",omitempty"` // previous status of UPDATED
+}
+
+// cardWatch syncs a card once per interval for all of its subscribers
+type cardWatch struct {
+	card        string
+	subscribers map[chan txEvent]string // channel => API-Key of the subscriber
+	stop        chan struct{}
+}
+
+var watches = struct {
+	sync.Mutex
+	m map[string]*cardWatch
+}{m: make(map[string]*cardWatch)}
+
+// subscribe returns a channel of changes of card and a function to cancel the subscription;
+// apiKey is used to poll Extend while the subscriber stays, so only keys Extend shows the card to may subscribe
+func subscribe(card, apiKey string) (<-chan txEvent, func(), error) {
+	if _, err := verifyCard(apiKey, card); err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan txEvent, 64)
+	watches.Lock()
+	w, ok := watches.m[card]
+	if !ok {
+		w = &cardWatch{card: card, subscribers: make(map[chan txEvent]string), stop: make(chan struct{})}
+		watches.m[card] = w
+		go w.run()
+	}
+	w.subscribers[ch] = apiKey
+	watches.Unlock()
+	return ch, func() {
+		watches.Lock()
+		defer watches.Unlock()
+		if _, ok := w.subscribers[ch]; !ok {
+			return
+		}
+		delete(w.subscribers, ch)
+		close(ch)
+		if len(w.subscribers) == 0 {
+			delete(watches.m, card)
+			close(w.stop)
+		}
+	}, nil
+}
+
+func (w *cardWatch) run() {
+	ticker := time.NewTicker(*watchInterval)
+	defer ticker.Stop()
+	w.poll()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+// poll syncs the card with the key of any subscriber and publishes the changes
+func (w *cardWatch) poll() {
+	watches.Lock()
+	apiKey := ""
+	for _, k := range w.subscribers {
+		apiKey = k
+		break
+	}
+	watches.Unlock()
+	if apiKey == "" {
+		return
+	}
+	k, err := lookupKey(apiKey)
+	if err != nil {
+		log.Printf("watch %s: %v", w.card, err)
+		return
+	}
+	t, err := cardSession(apiKey, w.card)
+	if err != nil {
+		log.Printf("watch %s: %v", w.card, err)
+		return
+	}
+	events, err := syncCard(t.Token, w.card, k.Client)
+	if err != nil {
+		log.Printf("watch %s: %v", w.card, err)
+		return
+	}
+	if len(events) > 0 {
+		invalidateCard(w.card)
+	}
+	w.publish(events)
+}
+
+// diffTransactions returns events turning known into current
+func diffTransactions(card string, known map[string]tx, current []tx) []txEvent {
+	events := make([]txEvent, 0)
+	for _, t := range current {
+		if old, ok := known[t.Id]; !ok {
+			events = append(events, txEvent{Kind: txNew, Card: card, Tx: t})
+		} else if old.Status != t.Status {
+			events = append(events, txEvent{Kind: txUpdated, Card: card, Tx: t, Previous: old.Status})
+		}
+	}
+	return events
+}
+
+// publishEvents passes events of card synced outside of its watch to the subscribers, if the card is watched
+func publishEvents(card string, events []txEvent) {
+	watches.Lock()
+	w, ok := watches.m[card]
+	watches.Unlock()
+	if ok {
+		w.publish(events)
+	}
+}
+
+func (w *cardWatch) publish(events []txEvent) {
+	watches.Lock()
+	defer watches.Unlock()
+	for _, e := range events {
+		for ch := range w.subscribers {
+			select {
+			case ch <- e:
+			default:
+				log.Printf("watch %s: subscriber is too slow, dropping %s %s", w.card, e.Kind, e.Tx.Id)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestDiffTransactions(t *testing.T) {
+	known := map[string]tx{
+		"t1": {Id: "t1", Status: "PENDING"},
+		"t2": {Id: "t2", Status: "CLEARED"},
+	}
+	events := diffTransactions("vc_1", known, []tx{
+		{Id: "t1", Status: "CLEARED"},
+		{Id: "t2", Status: "CLEARED"},
+		{Id: "t3", Status: "DECLINED"},
+	})
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %v", events)
+	}
+	if e := events[0]; e.Kind != txUpdated || e.Tx.Id != "t1" || e.Previous != "PENDING" || e.Card != "vc_1" {
+		t.Errorf("unexpected status change event %v", e)
+	}
+	if e := events[1]; e.Kind != txNew || e.Tx.Id != "t3" {
+		t.Errorf("unexpected new transaction event %v", e)
+	}
+}
+
+func TestSubscribeUnknownCard(t *testing.T) {
+	withExtendSession(t, "k2", "c2", permissions{}, extendCards("k2"))
+	if _, _, err := subscribe("vc_someone_elses", "k2"); err == nil {
+		t.Error("subscribing to a card Extend does not show to the key should fail")
+	}
+	watches.Lock()
+	_, ok := watches.m["vc_someone_elses"]
+	watches.Unlock()
+	if ok {
+		t.Error("no watch should start for a refused subscriber")
+	}
+}
+
+func TestPublishEvents(t *testing.T) {
+	ch := make(chan txEvent, 1)
+	watches.Lock()
+	watches.m["vc_published"] = &cardWatch{card: "vc_published", subscribers: map[chan txEvent]string{ch: "k"}}
+	watches.Unlock()
+	defer func() {
+		watches.Lock()
+		delete(watches.m, "vc_published")
+		watches.Unlock()
+	}()
+	publishEvents("vc_unwatched", []txEvent{{Kind: txNew, Card: "vc_unwatched"}})
+	publishEvents("vc_published", []txEvent{{Kind: txNew, Card: "vc_published", Tx: tx{Id: "t1"}}})
+	select {
+	case e := <-ch:
+		if e.Card != "vc_published" || e.Tx.Id != "t1" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	default:
+		t.Error("events of a watched card should reach its subscribers")
+	}
+}